@@ -0,0 +1,105 @@
+/*
+ * Copyright 2024 CloudWeGo Authors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package gzip
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"sync"
+
+	"github.com/andybalholm/brotli"
+)
+
+const (
+	BrotliBestCompression    = brotli.BestCompression
+	BrotliBestSpeed          = brotli.BestSpeed
+	BrotliDefaultCompression = brotli.DefaultCompression
+)
+
+var brotliWriterPools [brotli.BestCompression + 1]sync.Pool
+
+func normalizeBrotliLevel(level int) int {
+	if level < brotli.BestSpeed || level > brotli.BestCompression {
+		return brotli.DefaultCompression
+	}
+	return level
+}
+
+func acquireBrotliWriter(w io.Writer, level int) *brotli.Writer {
+	level = normalizeBrotliLevel(level)
+	if v := brotliWriterPools[level].Get(); v != nil {
+		bw := v.(*brotli.Writer)
+		bw.Reset(w)
+		return bw
+	}
+	return brotli.NewWriterLevel(w, level)
+}
+
+func releaseBrotliWriter(bw *brotli.Writer, level int) {
+	bw.Reset(nil)
+	brotliWriterPools[normalizeBrotliLevel(level)].Put(bw)
+}
+
+type brotliEncoder struct{}
+
+func (brotliEncoder) Name() string { return "br" }
+
+func (brotliEncoder) Levels() (min, max, def int) {
+	return brotli.BestSpeed, brotli.BestCompression, brotli.DefaultCompression
+}
+
+func (brotliEncoder) NewWriter(w io.Writer, level int) EncodeWriter {
+	return &pooledBrotliWriter{Writer: acquireBrotliWriter(w, level), level: level}
+}
+
+func (brotliEncoder) Append(dst, src []byte, level int) []byte {
+	buf := bytes.NewBuffer(dst)
+	bw := acquireBrotliWriter(buf, level)
+	_, _ = bw.Write(src)
+	_ = bw.Close()
+	releaseBrotliWriter(bw, level)
+	return buf.Bytes()
+}
+
+type pooledBrotliWriter struct {
+	*brotli.Writer
+	level int
+}
+
+func (w *pooledBrotliWriter) Close() error {
+	err := w.Writer.Close()
+	releaseBrotliWriter(w.Writer, w.level)
+	w.Writer = nil
+	return err
+}
+
+type brotliDecoder struct{}
+
+func (brotliDecoder) Name() string { return "br" }
+
+func (brotliDecoder) NewReader(r io.Reader) (io.ReadCloser, error) {
+	return ioutil.NopCloser(brotli.NewReader(r)), nil
+}
+
+func (brotliDecoder) Append(dst, src []byte) ([]byte, error) {
+	b, err := ioutil.ReadAll(brotli.NewReader(bytes.NewReader(src)))
+	if err != nil {
+		return dst, err
+	}
+	return append(dst, b...), nil
+}
@@ -45,48 +45,76 @@ import (
 	"context"
 	"path/filepath"
 	"strings"
+	"time"
 
 	"github.com/cloudwego/hertz/pkg/app/client"
-	"github.com/cloudwego/hertz/pkg/common/compress"
 	"github.com/cloudwego/hertz/pkg/protocol"
 )
 
 type gzipClientMiddleware struct {
 	*ClientOptions
-	level int
+	encoder Encoder
+	level   int
 }
 
 func newGzipClientMiddleware(level int, opts ...ClientOption) *gzipClientMiddleware {
 	middleware := &gzipClientMiddleware{
-		ClientOptions: DefaultClientOptions,
+		ClientOptions: DefaultClientOptions.clone(),
 		level:         level,
 	}
 	for _, fn := range opts {
 		fn(middleware.ClientOptions)
 	}
+	middleware.encoder = mustLookupEncoder("gzip")
+	if middleware.Encoding.Name != "" {
+		middleware.encoder = mustLookupEncoder(middleware.Encoding.Name)
+		level = middleware.Encoding.Level
+	}
+	middleware.level = normalizeLevel(middleware.encoder, level)
+	if middleware.AutoDecompress && middleware.DecompressFnForClient == nil {
+		middleware.DecompressFnForClient = StreamDecompressMiddlewareForClient
+	}
 	return middleware
 }
 
 func (g *gzipClientMiddleware) ClientMiddleware(next client.Endpoint) client.Endpoint {
 	return func(ctx context.Context, req *protocol.Request, resp *protocol.Response) (err error) {
-		if !g.shouldCompress(req) {
-			return
+		if skip := g.shouldCompress(req); skip != "" {
+			g.skipped(ctx, skip)
+		} else if body := req.Body(); len(body) > 0 {
+			req.SetHeader("Content-Encoding", g.encoder.Name())
+			req.SetHeader("Vary", "Accept-Encoding")
+			g.compress(ctx, req, body)
+		} else {
+			g.skipped(ctx, SkipNoBody)
 		}
 
-		req.SetHeader("Content-Encoding", "gzip")
-		req.SetHeader("Vary", "Accept-Encoding")
-		if len(req.Body()) > 0 {
-			gzipBytes := compress.AppendGzipBytesLevel(nil, req.Body(), g.level)
-			req.SetBodyStream(bytes.NewBuffer(gzipBytes), len(gzipBytes))
+		if g.AutoDecompress && req.Header.Get("Accept-Encoding") == "" {
+			req.SetHeader("Accept-Encoding", acceptEncoding())
 		}
 
 		err = next(ctx, req, resp)
 		if err != nil {
 			return err
 		}
-		if fn := g.DecompressFnForClient; fn != nil && strings.EqualFold(resp.Header.Get("Content-Encoding"), "gzip") {
+		if fn := g.DecompressFnForClient; fn != nil && canDecode(resp.Header.Get("Content-Encoding")) {
+			spanCtx, span := startSpan(ctx, g.Tracer, SpanDecompress,
+				Attribute{Key: AttrCoding, Value: resp.Header.Get("Content-Encoding")})
+			// streamed bodies are left unread, so that fn may decompress them on the fly
+			streamed := resp.IsBodyStream()
+			compressed := 0
+			if !streamed {
+				compressed = len(resp.Body())
+			}
 			f := fn(next)
-			err = f(ctx, req, resp)
+			err = f(withDecompressLimits(spanCtx, g.MaxDecompressedSize, g.MaxDecompressionRatio), req, resp)
+			if !streamed {
+				span.SetAttributes(sizeAttributes(len(resp.Body()), compressed)...)
+			}
+			if err != nil {
+				span.RecordError(err)
+			}
+			span.End()
 			if err != nil {
 				return err
 			}
@@ -95,25 +123,47 @@ func (g *gzipClientMiddleware) ClientMiddleware(next client.Endpoint) client.End
 	}
 }
 
-func (g *gzipClientMiddleware) shouldCompress(req *protocol.Request) bool {
-	if strings.Contains(req.Header.Get("Connection"), "Upgrade") ||
-		strings.Contains(req.Header.Get("Accept"), "text/event-stream") {
-		return false
+// compress replaces the body of req with body compressed.
+func (g *gzipClientMiddleware) compress(ctx context.Context, req *protocol.Request, body []byte) {
+	_, span := startSpan(ctx, g.Tracer, SpanCompress,
+		Attribute{Key: AttrCoding, Value: g.encoder.Name()}, Attribute{Key: AttrLevel, Value: g.level})
+	start := time.Now()
+	encoded := g.encoder.Append(nil, body, g.level)
+	recordCompressed(g.Metrics, g.encoder.Name(), len(body), len(encoded), time.Since(start))
+	span.SetAttributes(sizeAttributes(len(body), len(encoded))...)
+	span.End()
+	req.SetBodyStream(bytes.NewBuffer(encoded), len(encoded))
+}
+
+// skipped reports that the request body is sent uncompressed for reason.
+func (g *gzipClientMiddleware) skipped(ctx context.Context, reason SkipReason) {
+	recordSkipped(g.Metrics, reason)
+	traceSkipped(ctx, g.Tracer, reason)
+}
+
+// shouldCompress returns the reason why the body of req must not be
+// compressed, or an empty string if it may be.
+func (g *gzipClientMiddleware) shouldCompress(req *protocol.Request) SkipReason {
+	if strings.Contains(req.Header.Get("Connection"), "Upgrade") {
+		return SkipUpgrade
+	}
+	if strings.Contains(req.Header.Get("Accept"), "text/event-stream") {
+		return SkipEventStream
 	}
 
 	path := string(req.URI().RequestURI())
 
 	extension := filepath.Ext(path)
 	if g.ExcludedExtensions.Contains(extension) {
-		return false
+		return SkipExcludedExtension
 	}
 
 	if g.ExcludedPaths.Contains(path) {
-		return false
+		return SkipExcludedPath
 	}
 	if g.ExcludedPathRegexes.Contains(path) {
-		return false
+		return SkipExcludedPath
 	}
 
-	return true
+	return ""
 }
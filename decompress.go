@@ -0,0 +1,375 @@
+/*
+ * Copyright 2024 CloudWeGo Authors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package gzip
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+
+	"github.com/cloudwego/hertz/pkg/app"
+	"github.com/cloudwego/hertz/pkg/app/client"
+	"github.com/cloudwego/hertz/pkg/common/bytebufferpool"
+	"github.com/cloudwego/hertz/pkg/protocol"
+	"github.com/cloudwego/hertz/pkg/protocol/http1/ext"
+)
+
+// DecompressionLimitError is returned when a body decompresses to more bytes
+// than allowed by MaxDecompressedSize or MaxDecompressionRatio. Decompression
+// stops as soon as the limit is exceeded.
+type DecompressionLimitError struct {
+	// Limit is the number of decompressed bytes which were allowed.
+	Limit int
+}
+
+func (e *DecompressionLimitError) Error() string {
+	return fmt.Sprintf("gzip: decompressed body exceeds the limit of %d bytes", e.Limit)
+}
+
+// UnsupportedEncodingError is returned when a body is encoded with a
+// content-coding for which no decoder is registered.
+type UnsupportedEncodingError struct {
+	Coding string
+}
+
+func (e *UnsupportedEncodingError) Error() string {
+	return fmt.Sprintf("gzip: unsupported content-coding %q", e.Coding)
+}
+
+// DecompressFailure tells why a request body could not be decompressed.
+type DecompressFailure string
+
+const (
+	// DecompressCorrupt means the body is not valid data for its content-coding.
+	DecompressCorrupt DecompressFailure = "corrupt"
+	// DecompressSizeLimit means the body exceeds MaxDecompressedSize or
+	// MaxDecompressionRatio.
+	DecompressSizeLimit DecompressFailure = "size_limit"
+	// DecompressUnsupported means the body uses a content-coding for which no
+	// decoder is registered.
+	DecompressUnsupported DecompressFailure = "unsupported"
+)
+
+// DecompressErrorHandler writes the response to a request whose body failed to
+// decompress with err. The request is aborted once it returns.
+type DecompressErrorHandler func(ctx context.Context, c *app.RequestContext, failure DecompressFailure, err error)
+
+// decompressFailure classifies err returned while decompressing a body.
+func decompressFailure(err error) DecompressFailure {
+	var limitErr *DecompressionLimitError
+	var unsupportedErr *UnsupportedEncodingError
+	switch {
+	case errors.As(err, &limitErr):
+		return DecompressSizeLimit
+	case errors.As(err, &unsupportedErr):
+		return DecompressUnsupported
+	default:
+		return DecompressCorrupt
+	}
+}
+
+type decompressErrorHandlerKey struct{}
+
+// withDecompressErrorHandler returns ctx carrying the handler answering
+// requests whose body failed to decompress.
+func withDecompressErrorHandler(ctx context.Context, h DecompressErrorHandler) context.Context {
+	if h == nil {
+		return ctx
+	}
+	return context.WithValue(ctx, decompressErrorHandlerKey{}, h)
+}
+
+// abortDecompress aborts a request whose body failed to decompress with err,
+// through the DecompressErrorHandler carried by ctx if any, or else with
+// 413 Request Entity Too Large, 415 Unsupported Media Type or 400 Bad Request.
+func abortDecompress(ctx context.Context, c *app.RequestContext, err error) {
+	failure := decompressFailure(err)
+	h, _ := ctx.Value(decompressErrorHandlerKey{}).(DecompressErrorHandler)
+	if h == nil {
+		_ = c.AbortWithError(decompressFailureStatus(failure), err)
+		return
+	}
+	// kept for tracing, but never written to the response
+	_ = c.Error(err)
+	h(ctx, c, failure, err)
+	c.Abort()
+}
+
+// decompressFailureStatus returns the status code answering a request whose
+// body failed to decompress because of failure.
+func decompressFailureStatus(failure DecompressFailure) int {
+	switch failure {
+	case DecompressSizeLimit:
+		return http.StatusRequestEntityTooLarge
+	case DecompressUnsupported:
+		return http.StatusUnsupportedMediaType
+	default:
+		return http.StatusBadRequest
+	}
+}
+
+// decompressLimits bounds the size of decompressed bodies. Zero values
+// mean no limit.
+type decompressLimits struct {
+	maxSize  int
+	maxRatio int
+}
+
+type decompressLimitsKey struct{}
+
+// withDecompressLimits returns ctx carrying the limits to be enforced by
+// DefaultDecompressHandle and DefaultDecompressMiddlewareForClient.
+func withDecompressLimits(ctx context.Context, maxSize, maxRatio int) context.Context {
+	if maxSize <= 0 && maxRatio <= 0 {
+		return ctx
+	}
+	return context.WithValue(ctx, decompressLimitsKey{}, decompressLimits{maxSize: maxSize, maxRatio: maxRatio})
+}
+
+// limit returns the number of bytes a body of compressedSize bytes may
+// decompress to, or zero if it is unlimited.
+func (l decompressLimits) limit(compressedSize int) int {
+	limit := l.maxSize
+	if l.maxRatio > 0 {
+		if byRatio := l.maxRatio * compressedSize; limit <= 0 || byRatio < limit {
+			limit = byRatio
+		}
+	}
+	return limit
+}
+
+// decompress decodes body encoded with the codings listed in the Content-Encoding
+// header value, enforcing the limits carried by ctx at every step.
+func decompress(ctx context.Context, header string, body []byte) ([]byte, error) {
+	chain, err := decoderChain(header)
+	if err != nil {
+		return nil, err
+	}
+	limits, _ := ctx.Value(decompressLimitsKey{}).(decompressLimits)
+	limit := limits.limit(len(body))
+	for i := len(chain) - 1; i >= 0; i-- {
+		if body, err = decode(chain[i], body, limit); err != nil {
+			return nil, err
+		}
+	}
+	return body, nil
+}
+
+// decode decodes body with d, failing once more than limit bytes are produced
+// unless limit is zero.
+func decode(d Decoder, body []byte, limit int) ([]byte, error) {
+	if limit <= 0 {
+		return d.Append(nil, body)
+	}
+	r, err := d.NewReader(bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	var buf bytes.Buffer
+	n, err := buf.ReadFrom(io.LimitReader(r, int64(limit)+1))
+	if err != nil {
+		return nil, err
+	}
+	if n > int64(limit) {
+		return nil, &DecompressionLimitError{Limit: limit}
+	}
+	return buf.Bytes(), nil
+}
+
+// StreamDecompressHandle is a DecompressFn which decompresses the request body
+// while the handlers read it from c.Request.BodyStream(), so that large uploads
+// received with server.WithStreamBody(true) are never buffered in memory.
+// Only unsupported codings and malformed headers are rejected upfront, with
+// 415 Unsupported Media Type and 400 Bad Request, or by the handler set with
+// WithDecompressErrorHandler; corrupt data and bodies exceeding the
+// decompression limits fail the reads instead. Empty bodies are left untouched.
+func StreamDecompressHandle(ctx context.Context, c *app.RequestContext) {
+	var body io.Reader
+	if c.Request.Header.ContentLength() == 0 {
+		return
+	} else if c.Request.IsBodyStream() {
+		body = c.Request.BodyStream()
+	} else if len(c.Request.Body()) > 0 {
+		body = bytes.NewReader(c.Request.Body())
+	} else {
+		return
+	}
+	r, err := newDecompressReader(ctx, c.Request.Header.Get("Content-Encoding"), body)
+	if err != nil {
+		abortDecompress(ctx, c, err)
+		return
+	}
+	if r == nil {
+		return
+	}
+	c.Request.Header.DelBytes([]byte("Content-Encoding"))
+	c.Request.Header.DelBytes([]byte("Content-Length"))
+	// the body buffer may hold data prefetched by the original stream, which
+	// must not be overwritten if the handlers read the whole body
+	c.Request.ConstructBodyStream(&bytebufferpool.ByteBuffer{}, r)
+}
+
+// StreamDecompressMiddlewareForClient is a DecompressFnForClient which, for
+// responses received with client.WithResponseBodyStream(true), decompresses the
+// body while it is read from resp.BodyStream(). Closing the body stream releases
+// the decoder and the connection. Corrupt data and bodies exceeding the
+// decompression limits fail the reads. Other responses are decompressed as by
+// DefaultDecompressMiddlewareForClient. Responses to HEAD requests and other
+// responses without a body are left untouched.
+func StreamDecompressMiddlewareForClient(next client.Endpoint) client.Endpoint {
+	buffered := DefaultDecompressMiddlewareForClient(next)
+	return func(ctx context.Context, req *protocol.Request, resp *protocol.Response) error {
+		if !resp.IsBodyStream() {
+			return buffered(ctx, req, resp)
+		}
+		if req.Header.IsHead() || resp.Header.MustSkipContentLength() {
+			return nil
+		}
+		r, err := newDecompressReader(ctx, resp.Header.Get("Content-Encoding"), resp.BodyStream())
+		if r == nil || err != nil {
+			return err
+		}
+		resp.Header.DelBytes([]byte("Content-Encoding"))
+		resp.Header.DelBytes([]byte("Content-Length"))
+		resp.Header.DelBytes([]byte("Vary"))
+		resp.ConstructBodyStream(&bytebufferpool.ByteBuffer{}, r)
+		return nil
+	}
+}
+
+// countingReader counts the bytes read from r.
+type countingReader struct {
+	r io.Reader
+	n int
+}
+
+func (r *countingReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	r.n += n
+	return n, err
+}
+
+// decompressReader decodes a body as it is read, failing with a
+// *DecompressionLimitError as soon as it exceeds the limits.
+type decompressReader struct {
+	// decoders undo the codings of the body, the last one being read from.
+	decoders []io.ReadCloser
+	src      *countingReader
+	// body is the compressed body, released when the reader is closed.
+	body   io.Reader
+	limits decompressLimits
+	n      int
+	err    error
+}
+
+// newDecompressReader returns a reader decoding body encoded with the codings
+// listed in the Content-Encoding header value, enforcing the limits carried by
+// ctx, or nil if body turns out to be empty, which is then left as is like
+// empty bodies are by the buffered handlers.
+func newDecompressReader(ctx context.Context, header string, body io.Reader) (*decompressReader, error) {
+	src, err := peekBody(body)
+	if src == nil || err != nil {
+		return nil, err
+	}
+	chain, err := decoderChain(header)
+	if err != nil {
+		return nil, err
+	}
+	limits, _ := ctx.Value(decompressLimitsKey{}).(decompressLimits)
+	r := &decompressReader{src: &countingReader{r: src}, body: body, limits: limits}
+	var next io.Reader = r.src
+	for i := len(chain) - 1; i >= 0; i-- {
+		decoder, err := chain[i].NewReader(next)
+		if err != nil {
+			r.closeDecoders()
+			return nil, err
+		}
+		r.decoders = append(r.decoders, decoder)
+		next = decoder
+	}
+	return r, nil
+}
+
+// peekBody reads the first byte of body, so that empty bodies are told apart
+// before decoders fail to read their header. It returns a reader yielding the
+// whole body, or nil if body is empty.
+func peekBody(body io.Reader) (io.Reader, error) {
+	var b [1]byte
+	for {
+		n, err := body.Read(b[:])
+		if n > 0 {
+			return io.MultiReader(bytes.NewReader(b[:n]), body), nil
+		}
+		if err == io.EOF {
+			return nil, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+}
+
+func (r *decompressReader) Read(p []byte) (int, error) {
+	if r.err != nil {
+		return 0, r.err
+	}
+	n, err := r.decoders[len(r.decoders)-1].Read(p)
+	r.n += n
+	// the ratio is judged by the compressed bytes consumed so far
+	if limit := r.limits.limit(r.src.n); limit > 0 && r.n > limit {
+		r.err = &DecompressionLimitError{Limit: limit}
+		return n - (r.n - limit), r.err
+	}
+	if err != nil {
+		r.err = err
+	}
+	return n, err
+}
+
+// Close releases the decoder and the compressed body, skipping what is left
+// of the latter so that the connection can be reused.
+func (r *decompressReader) Close() error {
+	if r.decoders == nil {
+		return nil
+	}
+	err := r.closeDecoders()
+	r.err = io.ErrClosedPipe
+	if closer, ok := r.body.(io.Closer); ok {
+		if closeErr := closer.Close(); err == nil {
+			err = closeErr
+		}
+	} else if releaseErr := ext.ReleaseBodyStream(r.body); err == nil {
+		err = releaseErr
+	}
+	return err
+}
+
+// closeDecoders closes the decoders from the outermost one and returns the first error.
+func (r *decompressReader) closeDecoders() error {
+	var err error
+	for i := len(r.decoders) - 1; i >= 0; i-- {
+		if closeErr := r.decoders[i].Close(); err == nil {
+			err = closeErr
+		}
+	}
+	r.decoders = nil
+	return err
+}
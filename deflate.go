@@ -0,0 +1,119 @@
+/*
+ * Copyright 2024 CloudWeGo Authors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package gzip
+
+import (
+	"bufio"
+	"bytes"
+	"compress/flate"
+	"compress/zlib"
+	"io"
+	"io/ioutil"
+	"sync"
+)
+
+var zlibWriterPools [flate.BestCompression - flate.HuffmanOnly + 1]sync.Pool
+
+func normalizeDeflateLevel(level int) int {
+	if level < flate.HuffmanOnly || level > flate.BestCompression {
+		return flate.DefaultCompression
+	}
+	return level
+}
+
+func acquireZlibWriter(w io.Writer, level int) *zlib.Writer {
+	level = normalizeDeflateLevel(level)
+	if v := zlibWriterPools[level-flate.HuffmanOnly].Get(); v != nil {
+		zw := v.(*zlib.Writer)
+		zw.Reset(w)
+		return zw
+	}
+	zw, _ := zlib.NewWriterLevel(w, level)
+	return zw
+}
+
+func releaseZlibWriter(zw *zlib.Writer, level int) {
+	zw.Reset(nil)
+	zlibWriterPools[normalizeDeflateLevel(level)-flate.HuffmanOnly].Put(zw)
+}
+
+// isZlibHeader reports whether b starts with a valid zlib header (RFC 1950).
+func isZlibHeader(b []byte) bool {
+	return len(b) >= 2 && b[0]&0x0f == 8 && b[0]>>4 <= 7 && (uint16(b[0])<<8|uint16(b[1]))%31 == 0
+}
+
+// deflateEncoder produces zlib-wrapped deflate data, as required for the
+// "deflate" content-coding.
+type deflateEncoder struct{}
+
+func (deflateEncoder) Name() string { return "deflate" }
+
+func (deflateEncoder) Levels() (min, max, def int) {
+	return flate.HuffmanOnly, flate.BestCompression, flate.DefaultCompression
+}
+
+func (deflateEncoder) NewWriter(w io.Writer, level int) EncodeWriter {
+	return &pooledZlibWriter{Writer: acquireZlibWriter(w, level), level: level}
+}
+
+func (deflateEncoder) Append(dst, src []byte, level int) []byte {
+	buf := bytes.NewBuffer(dst)
+	zw := acquireZlibWriter(buf, level)
+	_, _ = zw.Write(src)
+	_ = zw.Close()
+	releaseZlibWriter(zw, level)
+	return buf.Bytes()
+}
+
+type pooledZlibWriter struct {
+	*zlib.Writer
+	level int
+}
+
+func (w *pooledZlibWriter) Close() error {
+	err := w.Writer.Close()
+	releaseZlibWriter(w.Writer, w.level)
+	w.Writer = nil
+	return err
+}
+
+// deflateDecoder decodes the "deflate" content-coding. Some implementations
+// send raw deflate data without the zlib wrapper, so both forms are accepted.
+type deflateDecoder struct{}
+
+func (deflateDecoder) Name() string { return "deflate" }
+
+func (deflateDecoder) NewReader(r io.Reader) (io.ReadCloser, error) {
+	br := bufio.NewReader(r)
+	if header, _ := br.Peek(2); isZlibHeader(header) {
+		return zlib.NewReader(br)
+	}
+	return flate.NewReader(br), nil
+}
+
+func (d deflateDecoder) Append(dst, src []byte) ([]byte, error) {
+	zr, err := d.NewReader(bytes.NewReader(src))
+	if err != nil {
+		return dst, err
+	}
+	defer zr.Close()
+	b, err := ioutil.ReadAll(zr)
+	if err != nil {
+		return dst, err
+	}
+	return append(dst, b...), nil
+}
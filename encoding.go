@@ -0,0 +1,281 @@
+/*
+ * Copyright 2024 CloudWeGo Authors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package gzip
+
+import (
+	"compress/flate"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/cloudwego/hertz/pkg/common/compress"
+)
+
+type (
+	// Encoder compresses data with a single content-coding.
+	// Implementations must be safe for concurrent use.
+	Encoder interface {
+		// Name returns the content-coding token, such as "gzip".
+		Name() string
+		// Levels returns the lowest, highest and default compression levels.
+		Levels() (min, max, def int)
+		// NewWriter returns a writer compressing into w at the given level.
+		// Closing it terminates the stream but must not close w.
+		// NewWriter may return nil if independently compressed members can be
+		// concatenated, in which case each streamed write is compressed with Append,
+		// at the cost of the history not being shared between writes.
+		NewWriter(w io.Writer, level int) EncodeWriter
+		// Append appends src compressed at the given level to dst and returns the result.
+		Append(dst, src []byte, level int) []byte
+	}
+
+	// EncodeWriter is a streaming compressor which can be flushed
+	// without terminating the stream.
+	EncodeWriter interface {
+		io.WriteCloser
+		Flush() error
+	}
+
+	// Decoder decompresses data encoded with a single content-coding.
+	// Implementations must be safe for concurrent use.
+	Decoder interface {
+		// Name returns the content-coding token, such as "gzip".
+		Name() string
+		// NewReader returns a reader decompressing r. Closing it must not close r.
+		// Unlike NewWriter, it must be implemented: the decompress handlers use it
+		// whenever decompression limits are set, and the streaming ones always do.
+		NewReader(r io.Reader) (io.ReadCloser, error)
+		// Append appends decompressed src to dst and returns the result.
+		Append(dst, src []byte) ([]byte, error)
+	}
+)
+
+var (
+	registryLock sync.RWMutex
+	encoders     = make(map[string]Encoder)
+	decoders     = make(map[string]Decoder)
+)
+
+func init() {
+	RegisterEncoder(gzipEncoder{})
+	RegisterEncoder(brotliEncoder{})
+	RegisterEncoder(zstdEncoder{})
+	RegisterEncoder(deflateEncoder{})
+
+	RegisterDecoder(gzipDecoder{})
+	RegisterDecoder(brotliDecoder{})
+	RegisterDecoder(zstdDecoder{})
+	RegisterDecoder(deflateDecoder{})
+}
+
+// RegisterEncoder makes e available to the middlewares under its name,
+// replacing any encoder previously registered with the same name.
+// Encoders must be registered before the middlewares using them are created.
+func RegisterEncoder(e Encoder) {
+	registryLock.Lock()
+	defer registryLock.Unlock()
+	encoders[strings.ToLower(e.Name())] = e
+}
+
+// RegisterDecoder makes d available to the decompress handlers under its name,
+// replacing any decoder previously registered with the same name.
+func RegisterDecoder(d Decoder) {
+	registryLock.Lock()
+	defer registryLock.Unlock()
+	decoders[strings.ToLower(d.Name())] = d
+}
+
+// LookupEncoder returns the encoder registered for the given content-coding.
+func LookupEncoder(name string) (Encoder, bool) {
+	registryLock.RLock()
+	defer registryLock.RUnlock()
+	e, ok := encoders[strings.ToLower(strings.TrimSpace(name))]
+	return e, ok
+}
+
+// LookupDecoder returns the decoder registered for the given content-coding.
+func LookupDecoder(name string) (Decoder, bool) {
+	registryLock.RLock()
+	defer registryLock.RUnlock()
+	d, ok := decoders[strings.ToLower(strings.TrimSpace(name))]
+	return d, ok
+}
+
+// acceptEncoding returns an Accept-Encoding header value listing the
+// registered decoders, gzip first and the others in alphabetical order.
+func acceptEncoding() string {
+	registryLock.RLock()
+	names := make([]string, 0, len(decoders))
+	for name := range decoders {
+		names = append(names, name)
+	}
+	registryLock.RUnlock()
+	sort.Slice(names, func(i, j int) bool {
+		if names[i] == "gzip" || names[j] == "gzip" {
+			return names[i] == "gzip"
+		}
+		return names[i] < names[j]
+	})
+	return strings.Join(names, ", ")
+}
+
+func mustLookupEncoder(name string) Encoder {
+	e, ok := LookupEncoder(name)
+	if !ok {
+		panic(fmt.Sprintf("gzip: no encoder registered for %q", name))
+	}
+	return e
+}
+
+// normalizeLevel returns level if it is within the range of e, or its default level otherwise.
+func normalizeLevel(e Encoder, level int) int {
+	min, max, def := e.Levels()
+	if level < min || level > max {
+		return def
+	}
+	return level
+}
+
+// canDecode reports whether the given Content-Encoding header value lists
+// content-codings, all of which have a registered decoder.
+func canDecode(header string) bool {
+	codings := parseContentEncoding(header)
+	if len(codings) == 0 {
+		return false
+	}
+	_, err := decoderChain(header)
+	return err == nil
+}
+
+// parseContentEncoding returns the content-codings listed in a Content-Encoding
+// header value, in the order they were applied. Codings are lower-cased,
+// "x-gzip" is treated as an alias of "gzip" and "identity" is dropped.
+func parseContentEncoding(header string) []string {
+	var codings []string
+	for _, coding := range strings.Split(header, ",") {
+		coding = strings.ToLower(strings.TrimSpace(coding))
+		switch coding {
+		case "", "identity":
+			continue
+		case "x-gzip":
+			coding = "gzip"
+		}
+		codings = append(codings, coding)
+	}
+	return codings
+}
+
+// decoderChain returns the decoders for the codings listed in a Content-Encoding
+// header value, in the order they were applied, or gzip if none is listed.
+func decoderChain(header string) ([]Decoder, error) {
+	codings := parseContentEncoding(header)
+	if len(codings) == 0 {
+		codings = []string{"gzip"}
+	}
+	chain := make([]Decoder, len(codings))
+	for i, coding := range codings {
+		d, ok := LookupDecoder(coding)
+		if !ok {
+			return nil, &UnsupportedEncodingError{Coding: coding}
+		}
+		chain[i] = d
+	}
+	return chain, nil
+}
+
+type gzipEncoder struct{}
+
+func (gzipEncoder) Name() string { return "gzip" }
+
+func (gzipEncoder) Levels() (min, max, def int) {
+	return flate.HuffmanOnly, BestCompression, DefaultCompression
+}
+
+func (gzipEncoder) NewWriter(w io.Writer, level int) EncodeWriter {
+	return &pooledGzipWriter{Writer: acquireGzipWriter(w, level), level: level}
+}
+
+func (gzipEncoder) Append(dst, src []byte, level int) []byte {
+	return compress.AppendGzipBytesLevel(dst, src, level)
+}
+
+var gzipWriterPools [BestCompression - flate.HuffmanOnly + 1]sync.Pool
+
+func normalizeGzipLevel(level int) int {
+	if level < flate.HuffmanOnly || level > BestCompression {
+		return DefaultCompression
+	}
+	return level
+}
+
+func acquireGzipWriter(w io.Writer, level int) *gzip.Writer {
+	level = normalizeGzipLevel(level)
+	if v := gzipWriterPools[level-flate.HuffmanOnly].Get(); v != nil {
+		zw := v.(*gzip.Writer)
+		zw.Reset(w)
+		return zw
+	}
+	zw, _ := gzip.NewWriterLevel(w, level)
+	return zw
+}
+
+func releaseGzipWriter(zw *gzip.Writer, level int) {
+	zw.Reset(nil)
+	gzipWriterPools[normalizeGzipLevel(level)-flate.HuffmanOnly].Put(zw)
+}
+
+type pooledGzipWriter struct {
+	*gzip.Writer
+	level int
+}
+
+func (w *pooledGzipWriter) Close() error {
+	err := w.Writer.Close()
+	releaseGzipWriter(w.Writer, w.level)
+	w.Writer = nil
+	return err
+}
+
+type gzipDecoder struct{}
+
+func (gzipDecoder) Name() string { return "gzip" }
+
+func (gzipDecoder) NewReader(r io.Reader) (io.ReadCloser, error) {
+	zr, err := compress.AcquireGzipReader(r)
+	if err != nil {
+		return nil, err
+	}
+	return &pooledGzipReader{Reader: zr}, nil
+}
+
+func (gzipDecoder) Append(dst, src []byte) ([]byte, error) {
+	return compress.AppendGunzipBytes(dst, src)
+}
+
+type pooledGzipReader struct {
+	*gzip.Reader
+}
+
+func (r *pooledGzipReader) Close() error {
+	err := r.Reader.Close()
+	compress.ReleaseGzipReader(r.Reader)
+	r.Reader = nil
+	return err
+}
@@ -0,0 +1,168 @@
+/*
+ * Copyright 2024 CloudWeGo Authors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package gzip
+
+import (
+	"strings"
+
+	"github.com/cloudwego/hertz/pkg/protocol"
+)
+
+// ETagPolicy controls how the server middlewares rewrite the ETag of
+// compressed responses, whose bytes differ from the uncompressed ones.
+type ETagPolicy int
+
+const (
+	// ETagKeep leaves ETags untouched.
+	ETagKeep ETagPolicy = iota
+	// ETagWeaken turns strong ETags of compressed responses into weak ones,
+	// e.g. "abc" becomes W/"abc".
+	ETagWeaken
+	// ETagSuffix appends the content-coding to ETags of compressed responses,
+	// e.g. "abc" becomes "abc-gzip".
+	ETagSuffix
+)
+
+// entityTag is a single element of an ETag, If-Match or If-None-Match header.
+type entityTag struct {
+	weak   bool
+	opaque string // without the surrounding quotes
+}
+
+func (t entityTag) String() string {
+	if t.weak {
+		return `W/"` + t.opaque + `"`
+	}
+	return `"` + t.opaque + `"`
+}
+
+// parseEntityTags parses a comma separated list of entity-tags as described in
+// RFC 9110 section 8.8.3. It returns false for "*" or malformed input.
+func parseEntityTags(header string) ([]entityTag, bool) {
+	var tags []entityTag
+	for s := header; ; {
+		s = strings.TrimLeft(s, " \t,")
+		if s == "" {
+			return tags, len(tags) > 0
+		}
+		var t entityTag
+		if strings.HasPrefix(s, "W/") {
+			t.weak = true
+			s = s[2:]
+		}
+		if len(s) < 2 || s[0] != '"' {
+			return nil, false
+		}
+		end := strings.IndexByte(s[1:], '"')
+		if end < 0 {
+			return nil, false
+		}
+		t.opaque = s[1 : end+1]
+		tags = append(tags, t)
+		s = s[end+2:]
+	}
+}
+
+func joinEntityTags(tags []entityTag) string {
+	res := make([]string, len(tags))
+	for i, t := range tags {
+		res[i] = t.String()
+	}
+	return strings.Join(res, ", ")
+}
+
+// rewrite returns the ETag of the response compressed with coding.
+func (p ETagPolicy) rewrite(etag, coding string) string {
+	tags, ok := parseEntityTags(etag)
+	if !ok || len(tags) != 1 {
+		return etag
+	}
+	t := tags[0]
+	switch p {
+	case ETagWeaken:
+		t.weak = true
+	case ETagSuffix:
+		t.opaque += "-" + coding
+	default:
+		return etag
+	}
+	return t.String()
+}
+
+// restore maps the entity-tags of a conditional request header back to the
+// ones of the uncompressed response, so handlers can compare them with their
+// own ETag. weak tells whether the header uses the weak comparison function,
+// as If-None-Match does. It reports whether any tag was rewritten.
+func (p ETagPolicy) restore(header string, codings []string, weak bool) (string, bool) {
+	tags, ok := parseEntityTags(header)
+	if !ok {
+		return header, false
+	}
+	restored := false
+	for i := range tags {
+		switch p {
+		case ETagWeaken:
+			// weak tags never match under the strong comparison function
+			if weak && tags[i].weak {
+				tags[i].weak = false
+				restored = true
+			}
+		case ETagSuffix:
+			for _, coding := range codings {
+				if strings.HasSuffix(tags[i].opaque, "-"+coding) {
+					tags[i].opaque = strings.TrimSuffix(tags[i].opaque, "-"+coding)
+					restored = true
+					break
+				}
+			}
+		}
+	}
+	if !restored {
+		return header, false
+	}
+	return joinEntityTags(tags), true
+}
+
+// restoreConditionalHeaders rewrites If-None-Match and If-Match on req
+// according to the ETag policy and reports whether If-None-Match referred to
+// a compressed response. If-Range is left alone: a range of a compressed
+// response must never be served from the uncompressed one.
+func (g *gzipSrvMiddleware) restoreConditionalHeaders(req *protocol.Request) bool {
+	if g.ETagPolicy == ETagKeep {
+		return false
+	}
+	var compressed bool
+	if v := req.Header.Get("If-None-Match"); v != "" {
+		if restored, ok := g.ETagPolicy.restore(v, g.encodings, true); ok {
+			req.Header.Set("If-None-Match", restored)
+			compressed = true
+		}
+	}
+	if v := req.Header.Get("If-Match"); v != "" {
+		if restored, ok := g.ETagPolicy.restore(v, g.encodings, false); ok {
+			req.Header.Set("If-Match", restored)
+		}
+	}
+	return compressed
+}
+
+// rewriteETag rewrites the ETag of resp, which is being compressed with coding.
+func (g *gzipSrvMiddleware) rewriteETag(resp *protocol.Response, coding string) {
+	if etag := resp.Header.Get("ETag"); etag != "" && g.ETagPolicy != ETagKeep {
+		resp.Header.Set("ETag", g.ETagPolicy.rewrite(etag, coding))
+	}
+}
@@ -56,7 +56,8 @@ import (
 
 func main() {
 	h := server.Default(server.WithHostPorts(":8081"))
-	h.Use(gzip.Gzip(gzip.DefaultCompression))
+	// "pong" is shorter than the default minimum length, so compress it regardless
+	h.Use(gzip.Gzip(gzip.DefaultCompression, gzip.WithMinLength(0)))
 	h.GET("/ping", func(ctx context.Context, c *app.RequestContext) {
 		c.String(http.StatusOK, "pong "+fmt.Sprint(time.Now().Unix()))
 	})
@@ -50,7 +50,6 @@ import (
 	"github.com/cloudwego/hertz/pkg/app"
 	"github.com/cloudwego/hertz/pkg/app/client"
 	"github.com/cloudwego/hertz/pkg/app/server"
-	"github.com/cloudwego/hertz/pkg/common/compress"
 	"github.com/cloudwego/hertz/pkg/protocol"
 	"github.com/cloudwego/hertz/pkg/protocol/consts"
 	"github.com/hertz-contrib/gzip"
@@ -74,6 +73,8 @@ func main() {
 	if err != nil {
 		panic(err)
 	}
+	// decompress the body while it is read from the body stream
+	cli.Use(gzip.GzipForClient(gzip.DefaultCompression, gzip.WithDecompressFnForClient(gzip.StreamDecompressMiddlewareForClient)))
 
 	req := protocol.AcquireRequest()
 	res := protocol.AcquireResponse()
@@ -86,12 +87,10 @@ func main() {
 		panic(err)
 	}
 
-	bodyStream := res.BodyStream()
+	// closing the body stream releases the gzip reader and the connection
+	defer res.CloseBodyStream() // nolint: errcheck
 
-	r, err := compress.AcquireGzipReader(bodyStream)
-	if err != nil {
-		panic(err)
-	}
+	r := res.BodyStream()
 
 	firstChunk := make([]byte, 10)
 	_, err = r.Read(firstChunk)
@@ -109,8 +108,4 @@ func main() {
 
 	otherChunks, _ := ioutil.ReadAll(r)
 	fmt.Println(fmt.Printf("%s", otherChunks))
-
-	if r != nil {
-		compress.ReleaseGzipReader(r)
-	}
 }
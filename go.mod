@@ -3,6 +3,8 @@ module github.com/hertz-contrib/gzip
 go 1.16
 
 require (
+	github.com/andybalholm/brotli v1.1.0
 	github.com/cloudwego/hertz v0.9.7
+	github.com/klauspost/compress v1.17.0
 	github.com/stretchr/testify v1.10.0
 )
@@ -42,21 +42,33 @@ package gzip
 
 import (
 	"bytes"
+	"compress/flate"
 	"compress/gzip"
+	"compress/zlib"
 	"context"
+	"errors"
 	"fmt"
+	"hash/crc32"
+	"io"
 	"io/ioutil"
+	"math/rand"
 	"net/http"
+	"net/url"
+	"path/filepath"
+	"runtime"
+	"sort"
 	"strconv"
 	"strings"
 	"testing"
 	"time"
 
+	"github.com/andybalholm/brotli"
 	"github.com/cloudwego/hertz/pkg/app"
 	"github.com/cloudwego/hertz/pkg/app/client"
 	"github.com/cloudwego/hertz/pkg/app/server"
 	"github.com/cloudwego/hertz/pkg/common/compress"
 	"github.com/cloudwego/hertz/pkg/common/config"
+	"github.com/cloudwego/hertz/pkg/common/test/mock"
 	"github.com/cloudwego/hertz/pkg/common/ut"
 	"github.com/cloudwego/hertz/pkg/protocol"
 	"github.com/cloudwego/hertz/pkg/protocol/consts"
@@ -70,7 +82,7 @@ const (
 
 func newServer() *route.Engine {
 	router := route.NewEngine(config.NewOptions([]config.Option{}))
-	router.Use(Gzip(DefaultCompression))
+	router.Use(Gzip(DefaultCompression, WithMinLength(0)))
 	router.GET("/", func(ctx context.Context, c *app.RequestContext) {
 		c.Header("Content-Length", strconv.Itoa(len(testResponse)))
 		c.String(200, testResponse)
@@ -104,9 +116,73 @@ func TestWildcard(t *testing.T) {
 	assert.Equal(t, fmt.Sprint(len(w.Body())), w.Header.Get("Content-Length"))
 }
 
+func TestAcceptEncodingNegotiation(t *testing.T) {
+	tests := []struct {
+		header   string
+		expected string
+	}{
+		{"", ""},
+		{"gzip", "gzip"},
+		{"GZIP", "gzip"},
+		{"x-gzip", "gzip"},
+		{"*", "gzip"},
+		{"deflate, gzip;q=0.5", "gzip"},
+		{"gzip;q=0", ""},
+		{"gzip ; q=0.000", ""},
+		{"identity;q=1, gzip;q=0", ""},
+		{"identity;q=1, gzip;q=0.5", ""},
+		{"identity;q=0.5, gzip", "gzip"},
+		{"*;q=0", ""},
+		{"*;q=0, gzip", "gzip"},
+		{"gzip;q=0, *", ""},
+		{"br, deflate", ""},
+		{"gzip;q=2", ""},
+		{"gzip;q=0.0001", ""},
+		{"gzip;level=1;q=0.8", "gzip"},
+	}
+	for _, test := range tests {
+		assert.Equal(t, test.expected, negotiateEncoding(test.header, []string{"gzip"}), test.header)
+	}
+}
+
+func TestGzipRefused(t *testing.T) {
+	for _, value := range []string{"gzip;q=0", "identity;q=1, gzip;q=0", "*;q=0"} {
+		request := ut.PerformRequest(newServer(), consts.MethodGet, "/", nil, ut.Header{
+			Key: "Accept-Encoding", Value: value,
+		})
+		w := request.Result()
+		assert.Equal(t, 200, w.StatusCode())
+		assert.Equal(t, "", w.Header.Get("Content-Encoding"), value)
+		assert.Equal(t, "", w.Header.Get("Vary"), value)
+		assert.Equal(t, testResponse, string(w.Body()), value)
+	}
+}
+
+func TestNegotiatedEncoding(t *testing.T) {
+	router := route.NewEngine(config.NewOptions([]config.Option{}))
+	router.Use(Gzip(DefaultCompression, WithMinLength(0)))
+	router.GET("/", func(ctx context.Context, c *app.RequestContext) {
+		c.String(200, NegotiatedEncoding(c))
+	})
+
+	request := ut.PerformRequest(router, consts.MethodGet, "/", nil, ut.Header{
+		Key: "Accept-Encoding", Value: "br;q=1, gzip;q=0.8",
+	})
+	w := request.Result()
+	body, err := compress.AppendGunzipBytes(nil, w.Body())
+	assert.Nil(t, err)
+	assert.Equal(t, "gzip", string(body))
+
+	request = ut.PerformRequest(router, consts.MethodGet, "/", nil, ut.Header{
+		Key: "Accept-Encoding", Value: "gzip;q=0",
+	})
+	w = request.Result()
+	assert.Equal(t, "", string(w.Body()))
+}
+
 func TestGzipPNG(t *testing.T) {
 	router := route.NewEngine(config.NewOptions([]config.Option{}))
-	router.Use(Gzip(DefaultCompression))
+	router.Use(Gzip(DefaultCompression, WithMinLength(0)))
 	router.GET("/image.png", func(ctx context.Context, c *app.RequestContext) {
 		c.String(200, "this is a PNG!")
 	})
@@ -122,7 +198,7 @@ func TestGzipPNG(t *testing.T) {
 
 func TestExcludedExtensions(t *testing.T) {
 	router := route.NewEngine(config.NewOptions([]config.Option{}))
-	router.Use(Gzip(DefaultCompression, WithExcludedExtensions([]string{".html"})))
+	router.Use(Gzip(DefaultCompression, WithMinLength(0), WithExcludedExtensions([]string{".html"})))
 	router.GET("/index.html", func(ctx context.Context, c *app.RequestContext) {
 		c.String(200, "this is a HTML!")
 	})
@@ -139,7 +215,7 @@ func TestExcludedExtensions(t *testing.T) {
 
 func TestExcludedPaths(t *testing.T) {
 	router := route.NewEngine(config.NewOptions([]config.Option{}))
-	router.Use(Gzip(DefaultCompression, WithExcludedPaths([]string{"/api/"})))
+	router.Use(Gzip(DefaultCompression, WithMinLength(0), WithExcludedPaths([]string{"/api/"})))
 	router.GET("/api/books", func(ctx context.Context, c *app.RequestContext) {
 		c.String(200, "this is books!")
 	})
@@ -405,7 +481,7 @@ func TestNoGzipForClient(t *testing.T) {
 func TestDecompressGzipForClient(t *testing.T) {
 	h := server.Default(server.WithHostPorts("127.0.0.1:2338"))
 
-	h.Use(Gzip(DefaultCompression, WithDecompressFn(DefaultDecompressHandle)))
+	h.Use(Gzip(DefaultCompression, WithMinLength(0), WithDecompressFn(DefaultDecompressHandle)))
 	h.GET("/", func(ctx context.Context, c *app.RequestContext) {
 		c.Header("Content-Length", strconv.Itoa(len(testResponse)))
 		c.String(200, testResponse)
@@ -456,7 +532,7 @@ chunk 9: hi~hi~hi~hi~hi~hi~hi~hi~hi~
 `
 	h := server.Default(server.WithHostPorts("127.0.0.1:2339"))
 
-	h.Use(GzipStream(DefaultCompression))
+	h.Use(GzipStream(DefaultCompression, WithMinLength(0)))
 	h.GET("/", func(ctx context.Context, c *app.RequestContext) {
 		for i := 0; i < 10; i++ {
 			c.Write([]byte(fmt.Sprintf("chunk %d: %s\n", i, strings.Repeat("hi~", i)))) // nolint: errcheck
@@ -519,3 +595,1707 @@ chunk 9: hi~hi~hi~hi~hi~hi~hi~hi~hi~
 	assert.Equal(t, secondData, string(secondChunk))
 	assert.Equal(t, otherData, string(otherChunks))
 }
+
+func TestBrotli(t *testing.T) {
+	router := route.NewEngine(config.NewOptions([]config.Option{}))
+	router.Use(Gzip(DefaultCompression, WithMinLength(0), WithBrotli(BrotliDefaultCompression)))
+	router.GET("/", func(ctx context.Context, c *app.RequestContext) {
+		c.String(200, testResponse)
+	})
+
+	request := ut.PerformRequest(router, consts.MethodGet, "/", nil, ut.Header{
+		Key: "Accept-Encoding", Value: "gzip, deflate, br",
+	})
+	w := request.Result()
+	assert.Equal(t, 200, w.StatusCode())
+	assert.Equal(t, "br", w.Header.Get("Content-Encoding"))
+	assert.Equal(t, "Accept-Encoding", w.Header.Get("Vary"))
+	assert.Equal(t, fmt.Sprint(len(w.Body())), w.Header.Get("Content-Length"))
+	body, err := ioutil.ReadAll(brotli.NewReader(bytes.NewReader(w.Body())))
+	assert.Nil(t, err)
+	assert.Equal(t, testResponse, string(body))
+
+	request = ut.PerformRequest(router, consts.MethodGet, "/", nil, ut.Header{
+		Key: "Accept-Encoding", Value: "gzip, br;q=0.5",
+	})
+	w = request.Result()
+	assert.Equal(t, "gzip", w.Header.Get("Content-Encoding"))
+}
+
+func TestStreamBrotli(t *testing.T) {
+	h := server.Default(server.WithHostPorts("127.0.0.1:2340"))
+
+	h.Use(GzipStream(DefaultCompression, WithMinLength(0), WithBrotli(BrotliBestSpeed)))
+	h.GET("/", func(ctx context.Context, c *app.RequestContext) {
+		for i := 0; i < 3; i++ {
+			c.Write([]byte(fmt.Sprintf("chunk %d: %s\n", i, strings.Repeat("hi~", i)))) // nolint: errcheck
+			c.Flush()                                                                   // nolint: errcheck
+		}
+	})
+
+	go h.Spin()
+
+	time.Sleep(time.Second)
+
+	c, _ := client.NewClient(client.WithResponseBodyStream(true))
+
+	req := &protocol.Request{}
+	resp := &protocol.Response{}
+
+	req.SetMethod(consts.MethodGet)
+	req.SetRequestURI("http://127.0.0.1:2340/")
+	req.Header.Set("Accept-Encoding", "br")
+
+	err := c.Do(context.Background(), req, resp)
+	if err != nil {
+		t.Fatalf("Get: %v", err)
+	}
+
+	body, err := ioutil.ReadAll(brotli.NewReader(resp.BodyStream()))
+	assert.Nil(t, err)
+	assert.Equal(t, "br", resp.Header.Get("Content-Encoding"))
+	assert.Equal(t, "chunked", resp.Header.Get("Transfer-Encoding"))
+	assert.Equal(t, "chunk 0: \nchunk 1: hi~\nchunk 2: hi~hi~\n", string(body))
+}
+
+func TestZstd(t *testing.T) {
+	router := route.NewEngine(config.NewOptions([]config.Option{}))
+	router.Use(Gzip(DefaultCompression, WithMinLength(0), WithZstd(ZstdDefaultCompression), WithDecompressFn(DefaultDecompressHandle)))
+	router.POST("/", func(ctx context.Context, c *app.RequestContext) {
+		c.Data(200, "text/plain", c.GetRawData())
+	})
+
+	body := zstdEncoder{}.Append(nil, []byte(testResponse), ZstdBestSpeed)
+	request := ut.PerformRequest(router, consts.MethodPost, "/", &ut.Body{Body: bytes.NewReader(body), Len: len(body)},
+		ut.Header{Key: "Content-Encoding", Value: "zstd"},
+		ut.Header{Key: "Accept-Encoding", Value: "gzip, zstd"})
+	w := request.Result()
+	assert.Equal(t, 200, w.StatusCode())
+	assert.Equal(t, "zstd", w.Header.Get("Content-Encoding"))
+	assert.Equal(t, "Accept-Encoding", w.Header.Get("Vary"))
+	decoded, err := zstdDecoder{}.Append(nil, w.Body())
+	assert.Nil(t, err)
+	assert.Equal(t, testResponse, string(decoded))
+}
+
+func TestZstdForClient(t *testing.T) {
+	h := server.Default(server.WithHostPorts("127.0.0.1:2341"))
+
+	h.Use(Gzip(DefaultCompression, WithMinLength(0), WithZstd(ZstdDefaultCompression), WithDecompressFn(DefaultDecompressHandle)))
+	h.POST("/", func(ctx context.Context, c *app.RequestContext) {
+		c.Data(200, "text/plain", c.GetRawData())
+	})
+
+	go h.Spin()
+
+	time.Sleep(time.Second)
+
+	cli, err := client.NewClient()
+	if err != nil {
+		panic(err)
+	}
+	cli.Use(GzipForClient(DefaultCompression, WithZstdForClient(ZstdBestSpeed), WithDecompressFnForClient(DefaultDecompressMiddlewareForClient)))
+
+	req := protocol.AcquireRequest()
+	res := protocol.AcquireResponse()
+
+	req.SetMethod(consts.MethodPost)
+	req.SetBodyString(testResponse)
+	req.SetRequestURI("http://127.0.0.1:2341/")
+	req.SetHeader("Accept-Encoding", "zstd")
+
+	err = cli.Do(context.Background(), req, res)
+	if err != nil {
+		t.Fatalf("Post: %v", err)
+	}
+
+	assert.Equal(t, 200, res.StatusCode())
+	assert.Equal(t, "zstd", req.Header.Get("Content-Encoding"))
+	assert.Equal(t, "", res.Header.Get("Content-Encoding"))
+	assert.Equal(t, testResponse, string(res.Body()))
+}
+
+func TestDeflate(t *testing.T) {
+	router := route.NewEngine(config.NewOptions([]config.Option{}))
+	router.Use(Gzip(DefaultCompression, WithMinLength(0), WithDeflate(DefaultCompression), WithDecompressFn(DefaultDecompressHandle)))
+	router.POST("/", func(ctx context.Context, c *app.RequestContext) {
+		c.Data(200, "text/plain", c.GetRawData())
+	})
+
+	raw := &bytes.Buffer{}
+	fw, _ := flate.NewWriter(raw, flate.BestSpeed)
+	fw.Write([]byte(testResponse)) // nolint: errcheck
+	fw.Close()
+
+	for _, body := range [][]byte{deflateEncoder{}.Append(nil, []byte(testResponse), BestSpeed), raw.Bytes()} {
+		request := ut.PerformRequest(router, consts.MethodPost, "/", &ut.Body{Body: bytes.NewReader(body), Len: len(body)},
+			ut.Header{Key: "Content-Encoding", Value: "deflate"},
+			ut.Header{Key: "Accept-Encoding", Value: "deflate"})
+		w := request.Result()
+		assert.Equal(t, 200, w.StatusCode())
+		assert.Equal(t, "deflate", w.Header.Get("Content-Encoding"))
+		assert.Equal(t, "Accept-Encoding", w.Header.Get("Vary"))
+		zr, err := zlib.NewReader(bytes.NewReader(w.Body()))
+		assert.Nil(t, err)
+		decoded, err := ioutil.ReadAll(zr)
+		assert.Nil(t, err)
+		assert.Equal(t, testResponse, string(decoded))
+	}
+}
+
+func TestStreamDeflate(t *testing.T) {
+	h := server.Default(server.WithHostPorts("127.0.0.1:2342"))
+
+	h.Use(GzipStream(DefaultCompression, WithMinLength(0), WithDeflate(BestSpeed)))
+	h.GET("/", func(ctx context.Context, c *app.RequestContext) {
+		for i := 0; i < 3; i++ {
+			c.Write([]byte(fmt.Sprintf("chunk %d: %s\n", i, strings.Repeat("hi~", i)))) // nolint: errcheck
+			c.Flush()                                                                   // nolint: errcheck
+		}
+	})
+
+	go h.Spin()
+
+	time.Sleep(time.Second)
+
+	c, _ := client.NewClient(client.WithResponseBodyStream(true))
+
+	req := &protocol.Request{}
+	resp := &protocol.Response{}
+
+	req.SetMethod(consts.MethodGet)
+	req.SetRequestURI("http://127.0.0.1:2342/")
+	req.Header.Set("Accept-Encoding", "deflate")
+
+	err := c.Do(context.Background(), req, resp)
+	if err != nil {
+		t.Fatalf("Get: %v", err)
+	}
+
+	zr, err := zlib.NewReader(resp.BodyStream())
+	assert.Nil(t, err)
+	body, err := ioutil.ReadAll(zr)
+	assert.Nil(t, err)
+	assert.Equal(t, "deflate", resp.Header.Get("Content-Encoding"))
+	assert.Equal(t, "chunk 0: \nchunk 1: hi~\nchunk 2: hi~hi~\n", string(body))
+}
+
+func TestDeflateForClient(t *testing.T) {
+	h := server.Default(server.WithHostPorts("127.0.0.1:2343"))
+
+	h.Use(Gzip(DefaultCompression, WithMinLength(0), WithDeflate(DefaultCompression), WithDecompressFn(DefaultDecompressHandle)))
+	h.POST("/", func(ctx context.Context, c *app.RequestContext) {
+		c.Data(200, "text/plain", c.GetRawData())
+	})
+
+	go h.Spin()
+
+	time.Sleep(time.Second)
+
+	cli, err := client.NewClient()
+	if err != nil {
+		panic(err)
+	}
+	cli.Use(GzipForClient(DefaultCompression, WithDeflateForClient(BestSpeed), WithDecompressFnForClient(DefaultDecompressMiddlewareForClient)))
+
+	req := protocol.AcquireRequest()
+	res := protocol.AcquireResponse()
+
+	req.SetMethod(consts.MethodPost)
+	req.SetBodyString(testResponse)
+	req.SetRequestURI("http://127.0.0.1:2343/")
+	req.SetHeader("Accept-Encoding", "deflate")
+
+	err = cli.Do(context.Background(), req, res)
+	if err != nil {
+		t.Fatalf("Post: %v", err)
+	}
+
+	assert.Equal(t, 200, res.StatusCode())
+	assert.Equal(t, "deflate", req.Header.Get("Content-Encoding"))
+	assert.Equal(t, "", res.Header.Get("Content-Encoding"))
+	assert.Equal(t, testResponse, string(res.Body()))
+}
+
+type reverseCoding struct{}
+
+func (reverseCoding) Name() string { return "x-reverse" }
+
+func (reverseCoding) Levels() (min, max, def int) { return 0, 0, 0 }
+
+func (reverseCoding) NewWriter(w io.Writer, level int) EncodeWriter { return nil }
+
+func (reverseCoding) Append(dst, src []byte, level int) []byte {
+	for i := len(src) - 1; i >= 0; i-- {
+		dst = append(dst, src[i])
+	}
+	return dst
+}
+
+type reverseDecoder struct{ reverseCoding }
+
+func (d reverseDecoder) NewReader(r io.Reader) (io.ReadCloser, error) {
+	src, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	return ioutil.NopCloser(bytes.NewReader(d.reverseCoding.Append(nil, src, 0))), nil
+}
+
+func (d reverseDecoder) Append(dst, src []byte) ([]byte, error) {
+	return d.reverseCoding.Append(dst, src, 0), nil
+}
+
+type mixedCaseCoding struct{ reverseCoding }
+
+func (mixedCaseCoding) Name() string { return "X-Mixed" }
+
+func TestMixedCaseEncoderName(t *testing.T) {
+	RegisterEncoder(mixedCaseCoding{})
+
+	router := route.NewEngine(config.NewOptions([]config.Option{}))
+	router.Use(Gzip(DefaultCompression, WithMinLength(0), WithEncoding("X-Mixed", 0)))
+	router.GET("/", func(ctx context.Context, c *app.RequestContext) {
+		c.String(200, "olleh")
+	})
+
+	w := ut.PerformRequest(router, consts.MethodGet, "/", nil,
+		ut.Header{Key: "Accept-Encoding", Value: "x-mixed"}).Result()
+	assert.Equal(t, "x-mixed", w.Header.Get("Content-Encoding"))
+	assert.Equal(t, "hello", string(w.Body()))
+}
+
+func TestCustomEncoder(t *testing.T) {
+	RegisterEncoder(reverseCoding{})
+	RegisterDecoder(reverseDecoder{})
+
+	e, ok := LookupEncoder("X-Reverse")
+	assert.True(t, ok)
+	assert.Equal(t, "x-reverse", e.Name())
+
+	router := route.NewEngine(config.NewOptions([]config.Option{}))
+	router.Use(Gzip(DefaultCompression, WithMinLength(0), WithEncoding("x-reverse", 0), WithDecompressFn(DefaultDecompressHandle),
+		WithMaxDecompressedSize(1<<10)))
+	router.POST("/", func(ctx context.Context, c *app.RequestContext) {
+		c.Data(200, "text/plain", c.GetRawData())
+	})
+
+	request := ut.PerformRequest(router, consts.MethodPost, "/", &ut.Body{Body: strings.NewReader("olleh"), Len: 5},
+		ut.Header{Key: "Content-Encoding", Value: "x-reverse"},
+		ut.Header{Key: "Accept-Encoding", Value: "x-reverse;q=0.9, gzip;q=0.1"})
+	w := request.Result()
+	assert.Equal(t, 200, w.StatusCode())
+	assert.Equal(t, "x-reverse", w.Header.Get("Content-Encoding"))
+	assert.Equal(t, "olleh", string(w.Body()))
+}
+
+func TestMinLength(t *testing.T) {
+	large := strings.Repeat(testResponse, 100)
+	router := route.NewEngine(config.NewOptions([]config.Option{}))
+	router.Use(Gzip(DefaultCompression, WithMinLength(DefaultMinLength)))
+	router.GET("/small", func(ctx context.Context, c *app.RequestContext) {
+		c.String(200, `{"ok":true}`)
+	})
+	router.GET("/large", func(ctx context.Context, c *app.RequestContext) {
+		c.String(200, large)
+	})
+
+	request := ut.PerformRequest(router, consts.MethodGet, "/small", nil, ut.Header{
+		Key: "Accept-Encoding", Value: "gzip",
+	})
+	w := request.Result()
+	assert.Equal(t, "", w.Header.Get("Content-Encoding"))
+	assert.Equal(t, `{"ok":true}`, string(w.Body()))
+
+	request = ut.PerformRequest(router, consts.MethodGet, "/large", nil, ut.Header{
+		Key: "Accept-Encoding", Value: "gzip",
+	})
+	w = request.Result()
+	assert.Equal(t, "gzip", w.Header.Get("Content-Encoding"))
+	body, err := compress.AppendGunzipBytes(nil, w.Body())
+	assert.Nil(t, err)
+	assert.Equal(t, large, string(body))
+}
+
+func TestStreamMinLength(t *testing.T) {
+	h := server.Default(server.WithHostPorts("127.0.0.1:2344"))
+
+	h.Use(GzipStream(DefaultCompression, WithMinLength(64)))
+	h.GET("/small", func(ctx context.Context, c *app.RequestContext) {
+		c.Write([]byte("chunk 0\n")) // nolint: errcheck
+		c.Write([]byte("chunk 1\n")) // nolint: errcheck
+	})
+	h.GET("/large", func(ctx context.Context, c *app.RequestContext) {
+		for i := 0; i < 10; i++ {
+			c.Write([]byte(fmt.Sprintf("chunk %d\n", i))) // nolint: errcheck
+		}
+		c.Flush() // nolint: errcheck
+	})
+
+	go h.Spin()
+
+	time.Sleep(time.Second)
+
+	c, _ := client.NewClient(client.WithResponseBodyStream(true))
+
+	req := &protocol.Request{}
+	resp := &protocol.Response{}
+	req.SetRequestURI("http://127.0.0.1:2344/small")
+	req.Header.Set("Accept-Encoding", "gzip")
+	if err := c.Do(context.Background(), req, resp); err != nil {
+		t.Fatalf("Get: %v", err)
+	}
+	body, err := ioutil.ReadAll(resp.BodyStream())
+	assert.Nil(t, err)
+	assert.Equal(t, "", resp.Header.Get("Content-Encoding"))
+	assert.Equal(t, "chunk 0\nchunk 1\n", string(body))
+
+	req = &protocol.Request{}
+	resp = &protocol.Response{}
+	req.SetRequestURI("http://127.0.0.1:2344/large")
+	req.Header.Set("Accept-Encoding", "gzip")
+	if err = c.Do(context.Background(), req, resp); err != nil {
+		t.Fatalf("Get: %v", err)
+	}
+	r, err := compress.AcquireGzipReader(resp.BodyStream())
+	assert.Nil(t, err)
+	body, err = ioutil.ReadAll(r)
+	assert.Nil(t, err)
+	assert.Equal(t, "gzip", resp.Header.Get("Content-Encoding"))
+	assert.Equal(t, 80, len(body))
+}
+
+func TestStreamSingleMember(t *testing.T) {
+	h := server.Default(server.WithHostPorts("127.0.0.1:2349"))
+
+	line := "chunk\n"
+	h.Use(GzipStream(DefaultCompression, WithMinLength(0)))
+	h.GET("/", func(ctx context.Context, c *app.RequestContext) {
+		for i := 0; i < 50; i++ {
+			c.Write([]byte(line)) // nolint: errcheck
+			c.Flush()             // nolint: errcheck
+		}
+	})
+
+	go h.Spin()
+
+	time.Sleep(time.Second)
+
+	c, _ := client.NewClient(client.WithResponseBodyStream(true))
+
+	req := &protocol.Request{}
+	resp := &protocol.Response{}
+	req.SetRequestURI("http://127.0.0.1:2349/")
+	req.Header.Set("Accept-Encoding", "gzip")
+	if err := c.Do(context.Background(), req, resp); err != nil {
+		t.Fatalf("Get: %v", err)
+	}
+	compressed, err := ioutil.ReadAll(resp.BodyStream())
+	assert.Nil(t, err)
+	assert.Equal(t, "gzip", resp.Header.Get("Content-Encoding"))
+
+	br := bytes.NewReader(compressed)
+	r, err := gzip.NewReader(br)
+	assert.Nil(t, err)
+	r.Multistream(false)
+	body, err := ioutil.ReadAll(r)
+	assert.Nil(t, err)
+	assert.Equal(t, strings.Repeat(line, 50), string(body))
+	// nothing may follow the first member
+	assert.Equal(t, 0, br.Len())
+}
+
+func TestChunkedWriterByteCounts(t *testing.T) {
+	srv := newGzipSrvMiddleware(DefaultCompression, WithMinLength(64))
+	resp := &protocol.Response{}
+	conn := mock.NewConn("")
+	w := newGzipChunkedWriter(context.Background(), resp, conn, srv, "gzip", false)
+
+	// io.Copy fails with io.ErrShortWrite if Write reports fewer bytes than it was given
+	data := strings.Repeat("hello world\n", 100)
+	n, err := io.Copy(w, strings.NewReader(data))
+	assert.Nil(t, err)
+	assert.Equal(t, int64(len(data)), n)
+
+	n2, err := w.Write(nil)
+	assert.Nil(t, err)
+	assert.Equal(t, 0, n2)
+
+	assert.Nil(t, w.Finalize())
+	assert.Equal(t, len(data), w.OriginalSize())
+	assert.True(t, w.CompressedSize() > 0)
+	assert.True(t, w.CompressedSize() < w.OriginalSize())
+
+	// bytes held back before deciding whether to compress are counted as well
+	w = newGzipChunkedWriter(context.Background(), &protocol.Response{}, mock.NewConn(""), srv, "gzip", false)
+	n2, err = w.Write([]byte("short"))
+	assert.Nil(t, err)
+	assert.Equal(t, 5, n2)
+	assert.Equal(t, 5, w.OriginalSize())
+	assert.Equal(t, 0, w.CompressedSize())
+	assert.Nil(t, w.Finalize())
+	assert.Equal(t, 5, w.CompressedSize())
+}
+
+func TestCompressionStats(t *testing.T) {
+	var stats *Stats
+	router := route.NewEngine(config.NewOptions([]config.Option{}))
+	router.Use(func(ctx context.Context, c *app.RequestContext) {
+		c.Next(ctx)
+		stats = CompressionStats(c)
+	})
+	router.Use(Gzip(DefaultCompression))
+	router.GET("/large", func(ctx context.Context, c *app.RequestContext) {
+		c.String(200, strings.Repeat(testResponse, 100))
+	})
+	router.GET("/small", func(ctx context.Context, c *app.RequestContext) {
+		c.String(200, testResponse)
+	})
+
+	w := ut.PerformRequest(router, consts.MethodGet, "/large", nil, ut.Header{Key: "Accept-Encoding", Value: "gzip"}).Result()
+	assert.NotNil(t, stats)
+	assert.Equal(t, "gzip", stats.Encoding)
+	assert.Equal(t, 100*len(testResponse), stats.OriginalSize)
+	assert.Equal(t, len(w.Body()), stats.CompressedSize)
+	assert.True(t, stats.Ratio() < 1)
+	assert.True(t, stats.Duration > 0)
+
+	ut.PerformRequest(router, consts.MethodGet, "/small", nil, ut.Header{Key: "Accept-Encoding", Value: "gzip"})
+	assert.NotNil(t, stats)
+	assert.Equal(t, "", stats.Encoding)
+	assert.Equal(t, len(testResponse), stats.OriginalSize)
+	assert.Equal(t, len(testResponse), stats.CompressedSize)
+	assert.Equal(t, float64(1), stats.Ratio())
+
+	ut.PerformRequest(router, consts.MethodGet, "/large", nil)
+	assert.Nil(t, stats)
+}
+
+func TestStreamCompressionStats(t *testing.T) {
+	srv := newGzipSrvMiddleware(DefaultCompression, WithMinLength(64))
+	w := newGzipChunkedWriter(context.Background(), &protocol.Response{}, mock.NewConn(""), srv, "gzip", false)
+
+	data := strings.Repeat("hello world\n", 100)
+	_, err := w.Write([]byte(data))
+	assert.Nil(t, err)
+	assert.Nil(t, w.Flush())
+	flushed := w.stats.CompressedSize
+	assert.True(t, flushed > 0)
+	assert.Nil(t, w.Finalize())
+
+	assert.Equal(t, "gzip", w.stats.Encoding)
+	assert.Equal(t, len(data), w.stats.OriginalSize)
+	assert.True(t, w.stats.CompressedSize > flushed)
+	assert.True(t, w.stats.Ratio() < 1)
+	assert.True(t, w.stats.Duration > 0)
+}
+
+func TestContentTypes(t *testing.T) {
+	router := route.NewEngine(config.NewOptions([]config.Option{}))
+	router.Use(Gzip(DefaultCompression, WithMinLength(0),
+		WithIncludedContentTypes([]string{"text/*", "application/*+json"}),
+		WithExcludedContentTypes([]string{"text/event-stream"})))
+	router.GET("/download", func(ctx context.Context, c *app.RequestContext) {
+		c.Data(200, c.Query("type"), []byte(testResponse))
+	})
+
+	tests := []struct {
+		contentType string
+		expected    string
+	}{
+		{"text/html; charset=utf-8", "gzip"},
+		{"application/vnd.api+json", "gzip"},
+		{"Application/Problem+JSON", "gzip"},
+		{"application/json", ""},
+		{"image/png", ""},
+		{"application/zip", ""},
+		{"text/event-stream", ""},
+	}
+	for _, test := range tests {
+		request := ut.PerformRequest(router, consts.MethodGet, "/download?type="+url.QueryEscape(test.contentType), nil,
+			ut.Header{Key: "Accept-Encoding", Value: "gzip"})
+		w := request.Result()
+		assert.Equal(t, test.expected, w.Header.Get("Content-Encoding"), test.contentType)
+	}
+}
+
+func TestStreamExcludedContentTypes(t *testing.T) {
+	h := server.Default(server.WithHostPorts("127.0.0.1:2345"))
+
+	h.Use(GzipStream(DefaultCompression, WithMinLength(0),
+		WithExcludedContentTypes([]string{"image/*"})))
+	h.GET("/download", func(ctx context.Context, c *app.RequestContext) {
+		c.SetContentType("image/png")
+		c.Write([]byte(testResponse)) // nolint: errcheck
+		c.Flush()                     // nolint: errcheck
+	})
+
+	go h.Spin()
+
+	time.Sleep(time.Second)
+
+	c, _ := client.NewClient()
+
+	req := &protocol.Request{}
+	resp := &protocol.Response{}
+	req.SetRequestURI("http://127.0.0.1:2345/download?id=5")
+	req.Header.Set("Accept-Encoding", "gzip")
+	if err := c.Do(context.Background(), req, resp); err != nil {
+		t.Fatalf("Get: %v", err)
+	}
+	assert.Equal(t, "", resp.Header.Get("Content-Encoding"))
+	assert.Equal(t, testResponse, string(resp.Body()))
+}
+
+func TestAlreadyEncoded(t *testing.T) {
+	encoded := compress.AppendGzipBytes(nil, []byte(testResponse))
+	router := route.NewEngine(config.NewOptions([]config.Option{}))
+	router.Use(Gzip(DefaultCompression, WithMinLength(0), WithBrotli(BrotliDefaultCompression)))
+	router.GET("/", func(ctx context.Context, c *app.RequestContext) {
+		c.Header("Content-Encoding", "gzip")
+		c.Data(200, "text/plain", encoded)
+	})
+	router.GET("/identity", func(ctx context.Context, c *app.RequestContext) {
+		c.Header("Content-Encoding", "identity")
+		c.Data(200, "text/plain", []byte(testResponse))
+	})
+
+	request := ut.PerformRequest(router, consts.MethodGet, "/", nil, ut.Header{
+		Key: "Accept-Encoding", Value: "br",
+	})
+	w := request.Result()
+	assert.Equal(t, "gzip", w.Header.Get("Content-Encoding"))
+	assert.Equal(t, encoded, w.Body())
+
+	request = ut.PerformRequest(router, consts.MethodGet, "/identity", nil, ut.Header{
+		Key: "Accept-Encoding", Value: "gzip",
+	})
+	w = request.Result()
+	assert.Equal(t, "gzip", w.Header.Get("Content-Encoding"))
+	body, err := compress.AppendGunzipBytes(nil, w.Body())
+	assert.Nil(t, err)
+	assert.Equal(t, testResponse, string(body))
+}
+
+func TestStreamAlreadyEncoded(t *testing.T) {
+	encoded := compress.AppendGzipBytes(nil, []byte(testResponse))
+	h := server.Default(server.WithHostPorts("127.0.0.1:2346"))
+
+	h.Use(GzipStream(DefaultCompression, WithMinLength(0)))
+	h.GET("/", func(ctx context.Context, c *app.RequestContext) {
+		c.Header("Content-Encoding", "gzip")
+		c.Write(encoded) // nolint: errcheck
+		c.Flush()        // nolint: errcheck
+	})
+
+	go h.Spin()
+
+	time.Sleep(time.Second)
+
+	c, _ := client.NewClient()
+
+	req := &protocol.Request{}
+	resp := &protocol.Response{}
+	req.SetRequestURI("http://127.0.0.1:2346/")
+	req.Header.Set("Accept-Encoding", "gzip")
+	if err := c.Do(context.Background(), req, resp); err != nil {
+		t.Fatalf("Get: %v", err)
+	}
+	assert.Equal(t, "gzip", resp.Header.Get("Content-Encoding"))
+	body, err := compress.AppendGunzipBytes(nil, resp.Body())
+	assert.Nil(t, err)
+	assert.Equal(t, testResponse, string(body))
+}
+
+func TestBodylessResponses(t *testing.T) {
+	router := route.NewEngine(config.NewOptions([]config.Option{}))
+	router.Use(Gzip(DefaultCompression, WithMinLength(0)))
+	router.GET("/no-content", func(ctx context.Context, c *app.RequestContext) {
+		c.String(http.StatusNoContent, testResponse)
+	})
+	router.GET("/not-modified", func(ctx context.Context, c *app.RequestContext) {
+		c.String(http.StatusNotModified, testResponse)
+	})
+	router.HEAD("/", func(ctx context.Context, c *app.RequestContext) {
+		c.String(http.StatusOK, testResponse)
+	})
+	router.HEAD("/declared", func(ctx context.Context, c *app.RequestContext) {
+		c.SetContentType("text/plain")
+		c.Response.Header.SetContentLength(4096)
+	})
+
+	for _, uri := range []string{"/no-content", "/not-modified"} {
+		request := ut.PerformRequest(router, consts.MethodGet, uri, nil, ut.Header{
+			Key: "Accept-Encoding", Value: "gzip",
+		})
+		w := request.Result()
+		assert.Equal(t, "", w.Header.Get("Content-Encoding"), uri)
+		assert.Equal(t, "", w.Header.Get("Vary"), uri)
+		assert.Equal(t, "", w.Header.Get("Transfer-Encoding"), uri)
+	}
+
+	request := ut.PerformRequest(router, consts.MethodHead, "/", nil, ut.Header{
+		Key: "Accept-Encoding", Value: "gzip",
+	})
+	w := request.Result()
+	assert.Equal(t, "gzip", w.Header.Get("Content-Encoding"))
+	assert.Equal(t, "Accept-Encoding", w.Header.Get("Vary"))
+
+	request = ut.PerformRequest(router, consts.MethodHead, "/declared", nil, ut.Header{
+		Key: "Accept-Encoding", Value: "gzip",
+	})
+	w = request.Result()
+	assert.Equal(t, "gzip", w.Header.Get("Content-Encoding"))
+	assert.NotEqual(t, "4096", w.Header.Get("Content-Length"))
+}
+
+func TestStreamHeadDeclaredLength(t *testing.T) {
+	h := server.Default(server.WithHostPorts("127.0.0.1:2353"))
+
+	h.Use(GzipStream(DefaultCompression))
+	h.HEAD("/large", func(ctx context.Context, c *app.RequestContext) {
+		c.Response.Header.SetContentLength(5000)
+	})
+	h.HEAD("/small", func(ctx context.Context, c *app.RequestContext) {
+		c.Response.Header.SetContentLength(5)
+	})
+
+	go h.Spin()
+
+	time.Sleep(time.Second)
+
+	c, _ := client.NewClient()
+
+	for uri, coding := range map[string]string{"/large": "gzip", "/small": ""} {
+		req := &protocol.Request{}
+		resp := &protocol.Response{}
+		req.SetMethod(consts.MethodHead)
+		req.SetRequestURI("http://127.0.0.1:2353" + uri)
+		req.Header.Set("Accept-Encoding", "gzip")
+		if err := c.Do(context.Background(), req, resp); err != nil {
+			t.Fatalf("Head: %v", err)
+		}
+		assert.Equal(t, coding, resp.Header.Get("Content-Encoding"), uri)
+		assert.NotEqual(t, "chunked", resp.Header.Get("Transfer-Encoding"), uri)
+		assert.Equal(t, 0, len(resp.Body()), uri)
+		if coding == "" {
+			assert.Equal(t, 5, resp.Header.ContentLength(), uri)
+		}
+	}
+}
+
+func TestStreamBodylessResponses(t *testing.T) {
+	h := server.Default(server.WithHostPorts("127.0.0.1:2347"))
+
+	h.Use(GzipStream(DefaultCompression, WithMinLength(0)))
+	h.GET("/no-content", func(ctx context.Context, c *app.RequestContext) {
+		c.SetStatusCode(http.StatusNoContent)
+		c.Write([]byte(testResponse)) // nolint: errcheck
+	})
+	h.GET("/not-modified", func(ctx context.Context, c *app.RequestContext) {
+		c.SetStatusCode(http.StatusNotModified)
+	})
+	h.HEAD("/", func(ctx context.Context, c *app.RequestContext) {
+		c.Write([]byte(testResponse)) // nolint: errcheck
+	})
+
+	go h.Spin()
+
+	time.Sleep(time.Second)
+
+	c, _ := client.NewClient()
+
+	for _, uri := range []string{"/no-content", "/not-modified"} {
+		req := &protocol.Request{}
+		resp := &protocol.Response{}
+		req.SetRequestURI("http://127.0.0.1:2347" + uri)
+		req.Header.Set("Accept-Encoding", "gzip")
+		if err := c.Do(context.Background(), req, resp); err != nil {
+			t.Fatalf("Get: %v", err)
+		}
+		assert.Equal(t, "", resp.Header.Get("Content-Encoding"), uri)
+		assert.Equal(t, "", resp.Header.Get("Transfer-Encoding"), uri)
+		assert.Equal(t, 0, len(resp.Body()), uri)
+	}
+
+	req := &protocol.Request{}
+	resp := &protocol.Response{}
+	req.SetMethod(consts.MethodHead)
+	req.SetRequestURI("http://127.0.0.1:2347/")
+	req.Header.Set("Accept-Encoding", "gzip")
+	if err := c.Do(context.Background(), req, resp); err != nil {
+		t.Fatalf("Head: %v", err)
+	}
+	assert.Equal(t, "gzip", resp.Header.Get("Content-Encoding"))
+	assert.Equal(t, 0, len(resp.Body()))
+
+	// the connection must still be usable after the bodyless responses
+	req = &protocol.Request{}
+	resp = &protocol.Response{}
+	req.SetRequestURI("http://127.0.0.1:2347/no-content")
+	assert.Nil(t, c.Do(context.Background(), req, resp))
+	assert.Equal(t, http.StatusNoContent, resp.StatusCode())
+}
+
+func TestETagPolicy(t *testing.T) {
+	tests := []struct {
+		policy   ETagPolicy
+		etag     string
+		expected string
+	}{
+		{ETagKeep, `"abc"`, `"abc"`},
+		{ETagWeaken, `"abc"`, `W/"abc"`},
+		{ETagWeaken, `W/"abc"`, `W/"abc"`},
+		{ETagSuffix, `"abc"`, `"abc-gzip"`},
+		{ETagSuffix, `W/"abc"`, `W/"abc-gzip"`},
+		{ETagSuffix, `invalid`, `invalid`},
+	}
+	for _, test := range tests {
+		assert.Equal(t, test.expected, test.policy.rewrite(test.etag, "gzip"), test.etag)
+	}
+
+	restored, ok := ETagSuffix.restore(`"abc-gzip", W/"x,y-br", "def"`, []string{"br", "gzip"}, true)
+	assert.True(t, ok)
+	assert.Equal(t, `"abc", W/"x,y", "def"`, restored)
+	_, ok = ETagSuffix.restore(`*`, []string{"gzip"}, true)
+	assert.False(t, ok)
+	_, ok = ETagWeaken.restore(`W/"abc"`, []string{"gzip"}, false)
+	assert.False(t, ok)
+}
+
+func TestETagRewriting(t *testing.T) {
+	router := route.NewEngine(config.NewOptions([]config.Option{}))
+	router.Use(Gzip(DefaultCompression, WithMinLength(0), WithETagPolicy(ETagSuffix)))
+	router.GET("/", func(ctx context.Context, c *app.RequestContext) {
+		c.Header("ETag", `"abc"`)
+		if c.Request.Header.Get("If-None-Match") == `"abc"` {
+			c.Status(http.StatusNotModified)
+			return
+		}
+		c.String(http.StatusOK, testResponse)
+	})
+
+	request := ut.PerformRequest(router, consts.MethodGet, "/", nil, ut.Header{
+		Key: "Accept-Encoding", Value: "gzip",
+	})
+	w := request.Result()
+	assert.Equal(t, "gzip", w.Header.Get("Content-Encoding"))
+	assert.Equal(t, `"abc-gzip"`, w.Header.Get("ETag"))
+
+	request = ut.PerformRequest(router, consts.MethodGet, "/", nil,
+		ut.Header{Key: "Accept-Encoding", Value: "gzip"},
+		ut.Header{Key: "If-None-Match", Value: `"abc-gzip"`})
+	w = request.Result()
+	assert.Equal(t, http.StatusNotModified, w.StatusCode())
+	assert.Equal(t, `"abc-gzip"`, w.Header.Get("ETag"))
+
+	request = ut.PerformRequest(router, consts.MethodGet, "/", nil,
+		ut.Header{Key: "If-None-Match", Value: `"abc"`})
+	w = request.Result()
+	assert.Equal(t, http.StatusNotModified, w.StatusCode())
+	assert.Equal(t, `"abc"`, w.Header.Get("ETag"))
+
+	router = route.NewEngine(config.NewOptions([]config.Option{}))
+	router.Use(Gzip(DefaultCompression, WithMinLength(0), WithETagPolicy(ETagWeaken)))
+	router.GET("/", func(ctx context.Context, c *app.RequestContext) {
+		c.Header("ETag", `"abc"`)
+		if c.Request.Header.Get("If-None-Match") == `"abc"` {
+			c.Status(http.StatusNotModified)
+			return
+		}
+		c.String(http.StatusOK, testResponse)
+	})
+
+	request = ut.PerformRequest(router, consts.MethodGet, "/", nil, ut.Header{
+		Key: "Accept-Encoding", Value: "gzip",
+	})
+	w = request.Result()
+	assert.Equal(t, `W/"abc"`, w.Header.Get("ETag"))
+
+	request = ut.PerformRequest(router, consts.MethodGet, "/", nil,
+		ut.Header{Key: "Accept-Encoding", Value: "gzip"},
+		ut.Header{Key: "If-None-Match", Value: `W/"abc"`})
+	w = request.Result()
+	assert.Equal(t, http.StatusNotModified, w.StatusCode())
+	assert.Equal(t, `W/"abc"`, w.Header.Get("ETag"))
+}
+
+func newRangeServer(t *testing.T, policy RangePolicy) (*route.Engine, string) {
+	dir := t.TempDir()
+	content := strings.Repeat(testResponse, 100)
+	if err := ioutil.WriteFile(filepath.Join(dir, "data.txt"), []byte(content), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	// too small to be compressed
+	if err := ioutil.WriteFile(filepath.Join(dir, "small.txt"), []byte(testResponse), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	router := route.NewEngine(config.NewOptions([]config.Option{}))
+	router.Use(Gzip(DefaultCompression, WithRangePolicy(policy)))
+	router.StaticFS("/static", &app.FS{Root: dir, AcceptByteRange: true, PathRewrite: app.NewPathSlashesStripper(1)})
+	return router, content
+}
+
+func TestRangeSkip(t *testing.T) {
+	router, content := newRangeServer(t, RangeSkip)
+
+	request := ut.PerformRequest(router, consts.MethodGet, "/static/data.txt", nil,
+		ut.Header{Key: "Accept-Encoding", Value: "gzip"},
+		ut.Header{Key: "Range", Value: "bytes=0-9"})
+	w := request.Result()
+	assert.Equal(t, http.StatusPartialContent, w.StatusCode())
+	assert.Equal(t, "", w.Header.Get("Content-Encoding"))
+	assert.Equal(t, content[:10], string(w.Body()))
+
+	request = ut.PerformRequest(router, consts.MethodGet, "/static/data.txt", nil,
+		ut.Header{Key: "Accept-Encoding", Value: "gzip"})
+	w = request.Result()
+	assert.Equal(t, http.StatusOK, w.StatusCode())
+	assert.Equal(t, "gzip", w.Header.Get("Content-Encoding"))
+	body, err := compress.AppendGunzipBytes(nil, w.Body())
+	assert.Nil(t, err)
+	assert.Equal(t, content, string(body))
+}
+
+func TestRangeStrip(t *testing.T) {
+	router, content := newRangeServer(t, RangeStrip)
+
+	request := ut.PerformRequest(router, consts.MethodGet, "/static/data.txt", nil,
+		ut.Header{Key: "Accept-Encoding", Value: "gzip"},
+		ut.Header{Key: "Range", Value: "bytes=0-9"})
+	w := request.Result()
+	assert.Equal(t, http.StatusOK, w.StatusCode())
+	assert.Equal(t, "gzip", w.Header.Get("Content-Encoding"))
+	assert.Equal(t, "", w.Header.Get("Accept-Ranges"))
+	body, err := compress.AppendGunzipBytes(nil, w.Body())
+	assert.Nil(t, err)
+	assert.Equal(t, content, string(body))
+
+	// clients which cannot decode still get partial content
+	request = ut.PerformRequest(router, consts.MethodGet, "/static/data.txt", nil,
+		ut.Header{Key: "Range", Value: "bytes=0-9"})
+	w = request.Result()
+	assert.Equal(t, http.StatusPartialContent, w.StatusCode())
+	assert.Equal(t, "bytes", w.Header.Get("Accept-Ranges"))
+	assert.Equal(t, content[:10], string(w.Body()))
+
+	// responses left uncompressed do not advertise the ranges which were ignored
+	request = ut.PerformRequest(router, consts.MethodGet, "/static/small.txt", nil,
+		ut.Header{Key: "Accept-Encoding", Value: "gzip"},
+		ut.Header{Key: "Range", Value: "bytes=0-9"})
+	w = request.Result()
+	assert.Equal(t, http.StatusOK, w.StatusCode())
+	assert.Equal(t, "", w.Header.Get("Content-Encoding"))
+	assert.Equal(t, "", w.Header.Get("Accept-Ranges"))
+	assert.Equal(t, testResponse, string(w.Body()))
+
+	request = ut.PerformRequest(router, consts.MethodGet, "/static/small.txt", nil,
+		ut.Header{Key: "Accept-Encoding", Value: "gzip"})
+	w = request.Result()
+	assert.Equal(t, "bytes", w.Header.Get("Accept-Ranges"))
+}
+
+func TestPartialContentNotCompressed(t *testing.T) {
+	router := route.NewEngine(config.NewOptions([]config.Option{}))
+	router.Use(Gzip(DefaultCompression, WithMinLength(0), WithRangePolicy(RangeStrip)))
+	router.GET("/", func(ctx context.Context, c *app.RequestContext) {
+		c.Header("Content-Range", "bytes 0-17/100")
+		c.String(http.StatusPartialContent, testResponse)
+	})
+
+	request := ut.PerformRequest(router, consts.MethodGet, "/", nil,
+		ut.Header{Key: "Accept-Encoding", Value: "gzip"})
+	w := request.Result()
+	assert.Equal(t, http.StatusPartialContent, w.StatusCode())
+	assert.Equal(t, "", w.Header.Get("Content-Encoding"))
+	assert.Equal(t, testResponse, string(w.Body()))
+}
+
+func TestExcludedRequestsAreSentForClient(t *testing.T) {
+	h := server.Default(server.WithHostPorts("127.0.0.1:2348"))
+
+	h.Use(Gzip(DefaultCompression, WithMinLength(0)))
+	h.POST("/*path", func(ctx context.Context, c *app.RequestContext) {
+		c.Data(200, "text/plain", c.Request.Body())
+	})
+
+	go h.Spin()
+
+	time.Sleep(time.Second)
+
+	cli, err := client.NewClient()
+	if err != nil {
+		panic(err)
+	}
+	cli.Use(GzipForClient(DefaultCompression,
+		WithExcludedExtensionsForClient([]string{".png"}),
+		WithExcludedPathsForClient([]string{"/api/"}),
+		WithDecompressFnForClient(DefaultDecompressMiddlewareForClient)))
+
+	for _, uri := range []string{"/image.png", "/api/books", "/events"} {
+		req := protocol.AcquireRequest()
+		res := protocol.AcquireResponse()
+
+		req.SetMethod(consts.MethodPost)
+		req.SetBodyString(testResponse)
+		req.SetRequestURI("http://127.0.0.1:2348" + uri)
+		req.SetHeader("Accept-Encoding", "gzip")
+		if uri == "/events" {
+			req.SetHeader("Accept", "text/event-stream")
+		}
+
+		err = cli.Do(context.Background(), req, res)
+		if err != nil {
+			t.Fatalf("Post: %v", err)
+		}
+
+		assert.Equal(t, 200, res.StatusCode(), uri)
+		assert.Equal(t, "", req.Header.Get("Content-Encoding"), uri)
+		assert.Equal(t, "", res.Header.Get("Content-Encoding"), uri)
+		assert.Equal(t, testResponse, string(res.Body()), uri)
+	}
+}
+
+func TestOptionsAreIsolated(t *testing.T) {
+	excluded := route.NewEngine(config.NewOptions([]config.Option{}))
+	excluded.Use(Gzip(DefaultCompression, WithMinLength(0), WithExcludedExtensions([]string{".html"})))
+	excluded.GET("/index.html", func(ctx context.Context, c *app.RequestContext) {
+		c.String(200, testResponse)
+	})
+	assert.Panics(t, func() { Gzip(DefaultCompression, WithEncoding("x-unknown", 0)) })
+
+	router := route.NewEngine(config.NewOptions([]config.Option{}))
+	router.Use(Gzip(DefaultCompression, WithMinLength(0)))
+	router.GET("/index.html", func(ctx context.Context, c *app.RequestContext) {
+		c.String(200, testResponse)
+	})
+
+	w := ut.PerformRequest(excluded, consts.MethodGet, "/index.html", nil,
+		ut.Header{Key: "Accept-Encoding", Value: "gzip"}).Result()
+	assert.Equal(t, "", w.Header.Get("Content-Encoding"))
+
+	w = ut.PerformRequest(router, consts.MethodGet, "/index.html", nil,
+		ut.Header{Key: "Accept-Encoding", Value: "gzip"}).Result()
+	assert.Equal(t, "gzip", w.Header.Get("Content-Encoding"))
+
+	assert.Equal(t, DefaultExcludedExtensions, DefaultOptions.ExcludedExtensions)
+	assert.Equal(t, DefaultMinLength, DefaultOptions.MinLength)
+	assert.Empty(t, DefaultOptions.Encodings)
+
+	GzipForClient(DefaultCompression, WithZstdForClient(ZstdBestSpeed), WithExcludedPathsForClient([]string{"/api/"}))
+	assert.Equal(t, Encoding{}, DefaultClientOptions.Encoding)
+	assert.Empty(t, DefaultClientOptions.ExcludedPaths)
+}
+
+func TestMetrics(t *testing.T) {
+	metrics := NewMemoryMetrics()
+	router := route.NewEngine(config.NewOptions([]config.Option{}))
+	router.Use(Gzip(DefaultCompression, WithMetrics(metrics), WithExcludedContentTypes([]string{"image/*"})))
+	router.GET("/*path", func(ctx context.Context, c *app.RequestContext) {
+		switch c.Query("type") {
+		case "small":
+			c.String(200, testResponse)
+		case "image":
+			c.Data(200, "image/svg+xml", []byte(strings.Repeat(testResponse, 100)))
+		default:
+			c.String(200, strings.Repeat(testResponse, 100))
+		}
+	})
+
+	acceptGzip := ut.Header{Key: "Accept-Encoding", Value: "gzip"}
+	w := ut.PerformRequest(router, consts.MethodGet, "/", nil, acceptGzip).Result()
+	ut.PerformRequest(router, consts.MethodGet, "/", nil, acceptGzip)
+	ut.PerformRequest(router, consts.MethodGet, "/?type=small", nil, acceptGzip)
+	ut.PerformRequest(router, consts.MethodGet, "/?type=image", nil, acceptGzip)
+	ut.PerformRequest(router, consts.MethodGet, "/", nil)
+	ut.PerformRequest(router, consts.MethodGet, "/logo.png", nil, acceptGzip)
+
+	coding := Label{Name: LabelCoding, Value: "gzip"}
+	assert.Equal(t, float64(2), metrics.Counter(MetricCompressed, coding))
+	assert.Equal(t, float64(2*100*len(testResponse)), metrics.Counter(MetricBytesIn, coding))
+	assert.Equal(t, float64(2*len(w.Body())), metrics.Counter(MetricBytesOut, coding))
+	assert.Len(t, metrics.Observations(MetricCompressDuration, coding), 2)
+	for reason, count := range map[string]float64{
+		"too_small":          1,
+		"content_type":       1,
+		"not_accepted":       1,
+		"excluded_extension": 1,
+		"range":              0,
+	} {
+		assert.Equal(t, count, metrics.Counter(MetricSkipped, Label{Name: LabelReason, Value: reason}), reason)
+	}
+}
+
+func TestStreamMetrics(t *testing.T) {
+	metrics := NewMemoryMetrics()
+	srv := newGzipSrvMiddleware(DefaultCompression, WithMinLength(64), WithMetrics(metrics))
+
+	w := newGzipChunkedWriter(context.Background(), &protocol.Response{}, mock.NewConn(""), srv, "gzip", false)
+	data := strings.Repeat("hello world\n", 100)
+	_, err := w.Write([]byte(data))
+	assert.Nil(t, err)
+	assert.Equal(t, float64(0), metrics.Counter(MetricCompressed, Label{Name: LabelCoding, Value: "gzip"}))
+	assert.Nil(t, w.Finalize())
+	assert.Nil(t, w.Finalize())
+
+	coding := Label{Name: LabelCoding, Value: "gzip"}
+	assert.Equal(t, float64(1), metrics.Counter(MetricCompressed, coding))
+	assert.Equal(t, float64(len(data)), metrics.Counter(MetricBytesIn, coding))
+	assert.Equal(t, float64(w.CompressedSize()), metrics.Counter(MetricBytesOut, coding))
+	assert.Len(t, metrics.Observations(MetricCompressDuration, coding), 1)
+
+	w = newGzipChunkedWriter(context.Background(), &protocol.Response{}, mock.NewConn(""), srv, "gzip", false)
+	_, err = w.Write([]byte("short"))
+	assert.Nil(t, err)
+	assert.Nil(t, w.Finalize())
+	w = newGzipChunkedWriter(context.Background(), &protocol.Response{}, mock.NewConn(""), srv, "gzip", false)
+	assert.Nil(t, w.Finalize())
+
+	assert.Equal(t, float64(1), metrics.Counter(MetricSkipped, Label{Name: LabelReason, Value: "too_small"}))
+	assert.Equal(t, float64(1), metrics.Counter(MetricSkipped, Label{Name: LabelReason, Value: "no_body"}))
+}
+
+func TestMetricsForClient(t *testing.T) {
+	metrics := NewMemoryMetrics()
+	endpoint := newGzipClientMiddleware(DefaultCompression,
+		WithMetricsForClient(metrics),
+		WithExcludedPathsForClient([]string{"/api/"})).
+		ClientMiddleware(func(ctx context.Context, req *protocol.Request, resp *protocol.Response) error {
+			return nil
+		})
+
+	for _, uri := range []string{"/upload", "/api/books"} {
+		req := &protocol.Request{}
+		req.SetMethod(consts.MethodPost)
+		req.SetRequestURI("http://127.0.0.1" + uri)
+		req.SetBodyString(testResponse)
+		assert.Nil(t, endpoint(context.Background(), req, &protocol.Response{}))
+	}
+
+	coding := Label{Name: LabelCoding, Value: "gzip"}
+	assert.Equal(t, float64(1), metrics.Counter(MetricCompressed, coding))
+	assert.Equal(t, float64(len(testResponse)), metrics.Counter(MetricBytesIn, coding))
+	assert.Equal(t, float64(1), metrics.Counter(MetricSkipped, Label{Name: LabelReason, Value: "excluded_path"}))
+}
+
+func TestMemoryMetricsLabelOrder(t *testing.T) {
+	metrics := NewMemoryMetrics()
+	metrics.AddCounter("requests", 1, Label{"a", "1"}, Label{"b", "2"})
+	metrics.AddCounter("requests", 2, Label{"b", "2"}, Label{"a", "1"})
+	metrics.AddCounter("requests", 4)
+	assert.Equal(t, float64(3), metrics.Counter("requests", Label{"a", "1"}, Label{"b", "2"}))
+	assert.Equal(t, float64(4), metrics.Counter("requests"))
+}
+
+func TestTracing(t *testing.T) {
+	tracer := NewSpanRecorder()
+	router := route.NewEngine(config.NewOptions([]config.Option{}))
+	router.Use(Gzip(BestSpeed, WithTracer(tracer), WithDecompressFn(DefaultDecompressHandle)))
+	router.POST("/", func(ctx context.Context, c *app.RequestContext) {
+		c.String(200, strings.Repeat(string(c.Request.Body()), 100))
+	})
+
+	body := compress.AppendGzipBytes(nil, []byte(testResponse))
+	w := ut.PerformRequest(router, consts.MethodPost, "/", &ut.Body{Body: bytes.NewReader(body), Len: len(body)},
+		ut.Header{Key: "Accept-Encoding", Value: "gzip"},
+		ut.Header{Key: "Content-Encoding", Value: "gzip"}).Result()
+	assert.Equal(t, "gzip", w.Header.Get("Content-Encoding"))
+
+	spans := tracer.Spans()
+	assert.Len(t, spans, 2)
+	assert.Equal(t, SpanDecompress, spans[0].Name)
+	assert.Equal(t, "gzip", spans[0].Attributes[AttrCoding])
+	assert.Equal(t, len(testResponse), spans[0].Attributes[AttrOriginalSize])
+	assert.Equal(t, len(body), spans[0].Attributes[AttrCompressedSize])
+	assert.True(t, spans[0].Ended())
+
+	assert.Equal(t, SpanCompress, spans[1].Name)
+	assert.Equal(t, "gzip", spans[1].Attributes[AttrCoding])
+	assert.Equal(t, BestSpeed, spans[1].Attributes[AttrLevel])
+	assert.Equal(t, 100*len(testResponse), spans[1].Attributes[AttrOriginalSize])
+	assert.Equal(t, len(w.Body()), spans[1].Attributes[AttrCompressedSize])
+	assert.True(t, spans[1].Ended())
+
+	ut.PerformRequest(router, consts.MethodPost, "/", &ut.Body{Body: strings.NewReader("x"), Len: 1})
+	spans = tracer.Spans()
+	assert.Len(t, spans, 3)
+	assert.Equal(t, SpanCompress, spans[2].Name)
+	assert.Equal(t, "not_accepted", spans[2].Attributes[AttrSkipReason])
+	assert.True(t, spans[2].Ended())
+
+	ut.PerformRequest(router, consts.MethodPost, "/", &ut.Body{Body: strings.NewReader("corrupt"), Len: 7},
+		ut.Header{Key: "Content-Encoding", Value: "gzip"})
+	spans = tracer.Spans()
+	assert.Equal(t, SpanDecompress, spans[3].Name)
+	assert.Len(t, spans[3].Errors, 1)
+}
+
+func TestStreamTracing(t *testing.T) {
+	tracer := NewSpanRecorder()
+	srv := newGzipSrvMiddleware(DefaultCompression, WithMinLength(64), WithTracer(tracer))
+	w := newGzipChunkedWriter(context.Background(), &protocol.Response{}, mock.NewConn(""), srv, "gzip", false)
+
+	data := strings.Repeat("hello world\n", 100)
+	_, err := w.Write([]byte(data))
+	assert.Nil(t, err)
+	spans := tracer.Spans()
+	assert.Len(t, spans, 1)
+	assert.False(t, spans[0].Ended())
+
+	assert.Nil(t, w.Finalize())
+	spans = tracer.Spans()
+	assert.Len(t, spans, 1)
+	assert.Equal(t, SpanCompress, spans[0].Name)
+	assert.Equal(t, "gzip", spans[0].Attributes[AttrCoding])
+	assert.Equal(t, len(data), spans[0].Attributes[AttrOriginalSize])
+	assert.Equal(t, w.CompressedSize(), spans[0].Attributes[AttrCompressedSize])
+	assert.True(t, spans[0].Ended())
+
+	w = newGzipChunkedWriter(context.Background(), &protocol.Response{}, mock.NewConn(""), srv, "gzip", false)
+	_, err = w.Write([]byte("short"))
+	assert.Nil(t, err)
+	assert.Nil(t, w.Finalize())
+	spans = tracer.Spans()
+	assert.Len(t, spans, 2)
+	assert.Equal(t, "too_small", spans[1].Attributes[AttrSkipReason])
+}
+
+func TestTracingForClient(t *testing.T) {
+	tracer := NewSpanRecorder()
+	encoded := compress.AppendGzipBytes(nil, []byte(testResponse))
+	endpoint := newGzipClientMiddleware(DefaultCompression,
+		WithTracerForClient(tracer),
+		WithDecompressFnForClient(DefaultDecompressMiddlewareForClient)).
+		ClientMiddleware(func(ctx context.Context, req *protocol.Request, resp *protocol.Response) error {
+			resp.Header.Set("Content-Encoding", "gzip")
+			resp.SetBody(encoded)
+			return nil
+		})
+
+	req := &protocol.Request{}
+	req.SetMethod(consts.MethodPost)
+	req.SetRequestURI("http://127.0.0.1/upload")
+	req.SetBodyString(testResponse)
+	resp := &protocol.Response{}
+	assert.Nil(t, endpoint(context.Background(), req, resp))
+	assert.Equal(t, testResponse, string(resp.Body()))
+
+	spans := tracer.Spans()
+	assert.Len(t, spans, 2)
+	assert.Equal(t, SpanCompress, spans[0].Name)
+	assert.Equal(t, DefaultCompression, spans[0].Attributes[AttrLevel])
+	assert.Equal(t, len(testResponse), spans[0].Attributes[AttrOriginalSize])
+	assert.Equal(t, SpanDecompress, spans[1].Name)
+	assert.Equal(t, len(testResponse), spans[1].Attributes[AttrOriginalSize])
+	assert.Equal(t, len(encoded), spans[1].Attributes[AttrCompressedSize])
+	for _, span := range spans {
+		assert.Equal(t, "gzip", span.Attributes[AttrCoding])
+		assert.True(t, span.Ended())
+	}
+}
+
+func TestSkipReason(t *testing.T) {
+	var reason SkipReason
+	router := route.NewEngine(config.NewOptions([]config.Option{}))
+	router.Use(func(ctx context.Context, c *app.RequestContext) {
+		c.Next(ctx)
+		reason = CompressionSkipReason(c)
+	})
+	router.Use(Gzip(DefaultCompression, WithSkipReasonHeader("X-Gzip-Skip"),
+		WithExcludedPathRegexes([]string{"^/private/"}),
+		WithExcludedContentTypes([]string{"image/*"})))
+	router.GET("/*path", func(ctx context.Context, c *app.RequestContext) {
+		switch c.Query("type") {
+		case "small":
+			c.String(200, testResponse)
+		case "image":
+			c.Data(200, "image/svg+xml", []byte(strings.Repeat(testResponse, 100)))
+		case "encoded":
+			c.Header("Content-Encoding", "br")
+			c.String(200, strings.Repeat(testResponse, 100))
+		case "empty":
+			c.Status(204)
+		default:
+			c.String(200, strings.Repeat(testResponse, 100))
+		}
+	})
+
+	acceptGzip := ut.Header{Key: "Accept-Encoding", Value: "gzip"}
+	tests := []struct {
+		uri     string
+		headers []ut.Header
+		reason  SkipReason
+	}{
+		{"/", []ut.Header{acceptGzip}, ""},
+		{"/", nil, SkipNotAccepted},
+		{"/", []ut.Header{acceptGzip, {Key: "Range", Value: "bytes=0-1"}}, SkipRange},
+		{"/", []ut.Header{acceptGzip, {Key: "Connection", Value: "Upgrade"}}, SkipUpgrade},
+		{"/", []ut.Header{acceptGzip, {Key: "Accept", Value: "text/event-stream"}}, SkipEventStream},
+		{"/logo.png", []ut.Header{acceptGzip}, SkipExcludedExtension},
+		{"/private/data", []ut.Header{acceptGzip}, SkipExcludedPath},
+		{"/?type=small", []ut.Header{acceptGzip}, SkipTooSmall},
+		{"/?type=image", []ut.Header{acceptGzip}, SkipContentType},
+		{"/?type=encoded", []ut.Header{acceptGzip}, SkipAlreadyEncoded},
+		{"/?type=empty", []ut.Header{acceptGzip}, SkipNoBody},
+	}
+	for _, test := range tests {
+		w := ut.PerformRequest(router, consts.MethodGet, test.uri, nil, test.headers...).Result()
+		assert.Equal(t, test.reason, reason, test.uri)
+		assert.Equal(t, string(test.reason), w.Header.Get("X-Gzip-Skip"), test.uri)
+	}
+}
+
+func TestStreamSkipReason(t *testing.T) {
+	srv := newGzipSrvMiddleware(DefaultCompression, WithMinLength(64), WithSkipReasonHeader("X-Gzip-Skip"))
+
+	resp := &protocol.Response{}
+	w := newGzipChunkedWriter(context.Background(), resp, mock.NewConn(""), srv, "gzip", false)
+	_, err := w.Write([]byte("short"))
+	assert.Nil(t, err)
+	assert.Nil(t, w.Finalize())
+	assert.Equal(t, SkipTooSmall, w.stats.SkipReason)
+	assert.Equal(t, "too_small", resp.Header.Get("X-Gzip-Skip"))
+
+	// the size of a response flushed early is unknown, so it is compressed
+	resp = &protocol.Response{}
+	w = newGzipChunkedWriter(context.Background(), resp, mock.NewConn(""), srv, "gzip", false)
+	_, err = w.Write([]byte("short"))
+	assert.Nil(t, err)
+	assert.Nil(t, w.Flush())
+	_, err = w.Write([]byte(strings.Repeat("hello world\n", 500)))
+	assert.Nil(t, err)
+	assert.Nil(t, w.Finalize())
+	assert.Equal(t, SkipReason(""), w.stats.SkipReason)
+	assert.Equal(t, "", resp.Header.Get("X-Gzip-Skip"))
+	assert.Equal(t, "gzip", resp.Header.Get("Content-Encoding"))
+	assert.True(t, w.stats.CompressedSize < w.stats.OriginalSize)
+
+	resp = &protocol.Response{}
+	w = newGzipChunkedWriter(context.Background(), resp, mock.NewConn(""), srv, "gzip", false)
+	assert.Nil(t, w.Finalize())
+	assert.Equal(t, SkipNoBody, w.stats.SkipReason)
+	assert.Equal(t, "no_body", resp.Header.Get("X-Gzip-Skip"))
+
+	resp = &protocol.Response{}
+	w = newGzipChunkedWriter(context.Background(), resp, mock.NewConn(""), srv, "gzip", false)
+	_, err = w.Write([]byte(strings.Repeat("hello world\n", 100)))
+	assert.Nil(t, err)
+	assert.Nil(t, w.Finalize())
+	assert.Equal(t, SkipReason(""), w.stats.SkipReason)
+	assert.Equal(t, "", resp.Header.Get("X-Gzip-Skip"))
+}
+
+func TestDecompressionLimits(t *testing.T) {
+	bomb := compress.AppendGzipBytes(nil, make([]byte, 4<<20))
+	valid := compress.AppendGzipBytes(nil, []byte(testResponse))
+
+	for _, opt := range []Option{WithMaxDecompressedSize(1 << 20), WithMaxDecompressionRatio(100)} {
+		router := route.NewEngine(config.NewOptions([]config.Option{}))
+		router.Use(Gzip(DefaultCompression, WithDecompressFn(DefaultDecompressHandle), opt))
+		router.POST("/", func(ctx context.Context, c *app.RequestContext) {
+			c.String(200, strconv.Itoa(len(c.Request.Body())))
+		})
+
+		w := ut.PerformRequest(router, consts.MethodPost, "/", &ut.Body{Body: bytes.NewReader(bomb), Len: len(bomb)},
+			ut.Header{Key: "Content-Encoding", Value: "gzip"}).Result()
+		assert.Equal(t, http.StatusRequestEntityTooLarge, w.StatusCode())
+
+		w = ut.PerformRequest(router, consts.MethodPost, "/", &ut.Body{Body: bytes.NewReader(valid), Len: len(valid)},
+			ut.Header{Key: "Content-Encoding", Value: "gzip"}).Result()
+		assert.Equal(t, http.StatusOK, w.StatusCode())
+		assert.Equal(t, strconv.Itoa(len(testResponse)), string(w.Body()))
+
+		w = ut.PerformRequest(router, consts.MethodPost, "/", &ut.Body{Body: strings.NewReader("corrupt"), Len: 7},
+			ut.Header{Key: "Content-Encoding", Value: "gzip"}).Result()
+		assert.Equal(t, http.StatusBadRequest, w.StatusCode())
+	}
+}
+
+func TestDecompressionLimitsForClient(t *testing.T) {
+	bomb := compress.AppendGzipBytes(nil, make([]byte, 4<<20))
+	endpoint := newGzipClientMiddleware(DefaultCompression,
+		WithMaxDecompressedSizeForClient(1<<20),
+		WithDecompressFnForClient(DefaultDecompressMiddlewareForClient)).
+		ClientMiddleware(func(ctx context.Context, req *protocol.Request, resp *protocol.Response) error {
+			resp.Header.Set("Content-Encoding", "gzip")
+			resp.SetBody(bomb)
+			return nil
+		})
+
+	req := &protocol.Request{}
+	req.SetRequestURI("http://127.0.0.1/download")
+	err := endpoint(context.Background(), req, &protocol.Response{})
+	var limitErr *DecompressionLimitError
+	assert.True(t, errors.As(err, &limitErr))
+	assert.Equal(t, 1<<20, limitErr.Limit)
+}
+
+func TestZstdMaxWindow(t *testing.T) {
+	// a frame declaring a 512 MiB window, holding a 4 KiB RLE block
+	frame := []byte{0x28, 0xb5, 0x2f, 0xfd, 0x00, 19 << 3}
+	block := uint32(1) | uint32(1)<<1 | uint32(4096)<<3
+	frame = append(frame, byte(block), byte(block>>8), byte(block>>16), 'a')
+
+	for _, ctx := range []context.Context{context.Background(), withDecompressLimits(context.Background(), 1<<10, 0)} {
+		var before, after runtime.MemStats
+		runtime.ReadMemStats(&before)
+		_, err := decompress(ctx, "zstd", frame)
+		runtime.ReadMemStats(&after)
+		assert.NotNil(t, err)
+		assert.True(t, after.TotalAlloc-before.TotalAlloc < 64<<20)
+	}
+
+	// the same block within the allowed window decodes
+	frame[5] = 13 << 3
+	decoded, err := decompress(context.Background(), "zstd", frame)
+	assert.Nil(t, err)
+	assert.Equal(t, strings.Repeat("a", 4096), string(decoded))
+}
+
+func TestDecompressContentEncodingList(t *testing.T) {
+	deflated := deflateEncoder{}.Append(nil, []byte(testResponse), DefaultCompression)
+	layered := compress.AppendGzipBytes(nil, deflated)
+	gzipped := compress.AppendGzipBytes(nil, []byte(testResponse))
+
+	for _, handle := range []app.HandlerFunc{DefaultDecompressHandle, StreamDecompressHandle} {
+		router := route.NewEngine(config.NewOptions([]config.Option{}))
+		router.Use(Gzip(DefaultCompression, WithDecompressFn(handle)))
+		router.POST("/", func(ctx context.Context, c *app.RequestContext) {
+			c.String(200, string(c.Request.Body()))
+		})
+
+		w := ut.PerformRequest(router, consts.MethodPost, "/", &ut.Body{Body: bytes.NewReader(layered), Len: len(layered)},
+			ut.Header{Key: "Content-Encoding", Value: "deflate, gzip"}).Result()
+		assert.Equal(t, http.StatusOK, w.StatusCode())
+		assert.Equal(t, testResponse, string(w.Body()))
+
+		w = ut.PerformRequest(router, consts.MethodPost, "/", &ut.Body{Body: bytes.NewReader(gzipped), Len: len(gzipped)},
+			ut.Header{Key: "Content-Encoding", Value: "X-Gzip, identity"}).Result()
+		assert.Equal(t, http.StatusOK, w.StatusCode())
+		assert.Equal(t, testResponse, string(w.Body()))
+
+		w = ut.PerformRequest(router, consts.MethodPost, "/", &ut.Body{Body: bytes.NewReader(gzipped), Len: len(gzipped)},
+			ut.Header{Key: "Content-Encoding", Value: "compress, gzip"}).Result()
+		assert.Equal(t, http.StatusUnsupportedMediaType, w.StatusCode())
+
+		w = ut.PerformRequest(router, consts.MethodPost, "/", &ut.Body{Body: strings.NewReader("plain"), Len: 5},
+			ut.Header{Key: "Content-Encoding", Value: "identity"}).Result()
+		assert.Equal(t, http.StatusOK, w.StatusCode())
+		assert.Equal(t, "plain", string(w.Body()))
+	}
+}
+
+func TestParseContentEncoding(t *testing.T) {
+	assert.Equal(t, []string{"deflate", "gzip"}, parseContentEncoding(" Deflate ,x-gzip"))
+	assert.Nil(t, parseContentEncoding("identity, "))
+	assert.True(t, canDecode("gzip, br"))
+	assert.False(t, canDecode("gzip, compress"))
+	assert.False(t, canDecode(""))
+
+	type customGzipDecoder struct{ gzipDecoder }
+	RegisterDecoder(customGzipDecoder{})
+	chain, err := decoderChain("")
+	RegisterDecoder(gzipDecoder{})
+	assert.Nil(t, err)
+	assert.Equal(t, []Decoder{customGzipDecoder{}}, chain)
+
+	_, err = decoderChain("gzip, compress")
+	var unsupportedErr *UnsupportedEncodingError
+	assert.True(t, errors.As(err, &unsupportedErr))
+	assert.Equal(t, "compress", unsupportedErr.Coding)
+}
+
+func TestDecompressErrorHandler(t *testing.T) {
+	bomb := compress.AppendGzipBytes(nil, make([]byte, 4<<20))
+	valid := compress.AppendGzipBytes(nil, []byte(testResponse))
+
+	for _, handle := range []app.HandlerFunc{DefaultDecompressHandle, StreamDecompressHandle} {
+		var failures []DecompressFailure
+		router := route.NewEngine(config.NewOptions([]config.Option{}))
+		router.Use(Gzip(DefaultCompression, WithDecompressFn(handle), WithMaxDecompressedSize(1<<20),
+			WithDecompressErrorHandler(func(ctx context.Context, c *app.RequestContext, failure DecompressFailure, err error) {
+				failures = append(failures, failure)
+				c.JSON(http.StatusUnprocessableEntity, map[string]string{"error": string(failure)})
+			})))
+		router.POST("/", func(ctx context.Context, c *app.RequestContext) {
+			c.String(200, "handled")
+		})
+
+		w := ut.PerformRequest(router, consts.MethodPost, "/", &ut.Body{Body: strings.NewReader("corrupt"), Len: 7},
+			ut.Header{Key: "Content-Encoding", Value: "gzip"}).Result()
+		assert.Equal(t, http.StatusUnprocessableEntity, w.StatusCode())
+		assert.Equal(t, `{"error":"corrupt"}`, string(w.Body()))
+
+		w = ut.PerformRequest(router, consts.MethodPost, "/", &ut.Body{Body: bytes.NewReader(valid), Len: len(valid)},
+			ut.Header{Key: "Content-Encoding", Value: "compress"}).Result()
+		assert.Equal(t, http.StatusUnprocessableEntity, w.StatusCode())
+		assert.Equal(t, `{"error":"unsupported"}`, string(w.Body()))
+
+		w = ut.PerformRequest(router, consts.MethodPost, "/", &ut.Body{Body: bytes.NewReader(valid), Len: len(valid)},
+			ut.Header{Key: "Content-Encoding", Value: "gzip"}).Result()
+		assert.Equal(t, http.StatusOK, w.StatusCode())
+		assert.Equal(t, "handled", string(w.Body()))
+		assert.Equal(t, []DecompressFailure{DecompressCorrupt, DecompressUnsupported}, failures)
+	}
+
+	var failure DecompressFailure
+	router := route.NewEngine(config.NewOptions([]config.Option{}))
+	router.Use(Gzip(DefaultCompression, WithDecompressFn(DefaultDecompressHandle), WithMaxDecompressedSize(1<<20),
+		WithDecompressErrorHandler(func(ctx context.Context, c *app.RequestContext, f DecompressFailure, err error) {
+			failure = f
+			c.String(http.StatusRequestEntityTooLarge, "too large")
+		})))
+	router.POST("/", func(ctx context.Context, c *app.RequestContext) {
+		c.String(200, "handled")
+	})
+	w := ut.PerformRequest(router, consts.MethodPost, "/", &ut.Body{Body: bytes.NewReader(bomb), Len: len(bomb)},
+		ut.Header{Key: "Content-Encoding", Value: "gzip"}).Result()
+	assert.Equal(t, http.StatusRequestEntityTooLarge, w.StatusCode())
+	assert.Equal(t, "too large", string(w.Body()))
+	assert.Equal(t, DecompressSizeLimit, failure)
+}
+
+func TestStreamDecompressHandle(t *testing.T) {
+	h := server.Default(server.WithHostPorts("127.0.0.1:2350"), server.WithStreamBody(true))
+
+	h.Use(Gzip(DefaultCompression, WithDecompressFn(StreamDecompressHandle), WithMaxDecompressedSize(4<<20)))
+	h.POST("/", func(ctx context.Context, c *app.RequestContext) {
+		// read in small steps, as a handler processing a huge upload would
+		hash := crc32.NewIEEE()
+		n, err := io.CopyBuffer(hash, c.Request.BodyStream(), make([]byte, 512))
+		if n > 0 {
+			assert.Equal(t, "", c.Request.Header.Get("Content-Encoding"))
+		}
+		var limitErr *DecompressionLimitError
+		if errors.As(err, &limitErr) {
+			c.String(http.StatusRequestEntityTooLarge, err.Error())
+			return
+		}
+		if err != nil {
+			c.String(http.StatusBadRequest, err.Error())
+			return
+		}
+		c.String(200, fmt.Sprintf("%d %d", n, hash.Sum32()))
+	})
+
+	go h.Spin()
+
+	time.Sleep(time.Second)
+
+	data := make([]byte, 1<<20)
+	rand.New(rand.NewSource(1)).Read(data) // nolint: errcheck
+	bomb := compress.AppendGzipBytes(nil, make([]byte, 8<<20))
+
+	cli, _ := client.NewClient()
+	for _, test := range []struct {
+		body     []byte
+		encoding string
+		status   int
+		expected string
+		chunked  bool
+	}{
+		{compress.AppendGzipBytes(nil, data), "gzip", 200, fmt.Sprintf("%d %d", len(data), crc32.ChecksumIEEE(data)), false},
+		{bomb, "gzip", http.StatusRequestEntityTooLarge, "", false},
+		{[]byte(testResponse), "gzip", http.StatusBadRequest, "", false},
+		// an empty body is passed through, as by DefaultDecompressHandle
+		{nil, "gzip", 200, "0 0", false},
+		{nil, "gzip", 200, "0 0", true},
+		// the connection is reused after each failure
+		{[]byte(testResponse), "", 200, fmt.Sprintf("%d %d", len(testResponse), crc32.ChecksumIEEE([]byte(testResponse))), false},
+	} {
+		req := protocol.AcquireRequest()
+		res := protocol.AcquireResponse()
+		req.SetMethod(consts.MethodPost)
+		req.SetRequestURI("http://127.0.0.1:2350/")
+		if test.chunked {
+			req.SetBodyStream(bytes.NewReader(test.body), -1)
+		} else {
+			req.SetBody(test.body)
+		}
+		if test.encoding != "" {
+			req.SetHeader("Content-Encoding", test.encoding)
+		}
+		if err := cli.Do(context.Background(), req, res); err != nil {
+			t.Fatalf("Post: %v", err)
+		}
+		assert.Equal(t, test.status, res.StatusCode())
+		if test.expected != "" {
+			assert.Equal(t, test.expected, string(res.Body()))
+		}
+		protocol.ReleaseRequest(req)
+		protocol.ReleaseResponse(res)
+	}
+}
+
+func TestStreamDecompressMiddlewareForClient(t *testing.T) {
+	h := server.Default(server.WithHostPorts("127.0.0.1:2351"))
+
+	h.Use(GzipStream(DefaultCompression, WithMinLength(0)))
+	h.GET("/", func(ctx context.Context, c *app.RequestContext) {
+		for i := 0; i < 10; i++ {
+			c.Write([]byte(fmt.Sprintf("chunk %d\n", i))) // nolint: errcheck
+			c.Flush()                                     // nolint: errcheck
+		}
+	})
+
+	h.HEAD("/", func(ctx context.Context, c *app.RequestContext) {
+		c.Response.Header.SetContentLength(5000)
+	})
+	h.GET("/empty", func(ctx context.Context, c *app.RequestContext) {
+		c.Response.Header.Set("Content-Encoding", "gzip")
+	})
+
+	go h.Spin()
+
+	time.Sleep(time.Second)
+
+	var expected string
+	for i := 0; i < 10; i++ {
+		expected += fmt.Sprintf("chunk %d\n", i)
+	}
+
+	for _, stream := range []bool{true, false} {
+		cli, _ := client.NewClient(client.WithResponseBodyStream(stream))
+		cli.Use(GzipForClient(DefaultCompression, WithDecompressFnForClient(StreamDecompressMiddlewareForClient)))
+
+		for i := 0; i < 2; i++ {
+			req := protocol.AcquireRequest()
+			resp := protocol.AcquireResponse()
+			req.SetRequestURI("http://127.0.0.1:2351/")
+			req.Header.Set("Accept-Encoding", "gzip")
+			if err := cli.Do(context.Background(), req, resp); err != nil {
+				t.Fatalf("Get: %v", err)
+			}
+			assert.Equal(t, "", resp.Header.Get("Content-Encoding"))
+
+			if stream {
+				r, ok := resp.BodyStream().(*decompressReader)
+				assert.True(t, ok)
+				body, err := ioutil.ReadAll(resp.BodyStream())
+				assert.Nil(t, err)
+				assert.Equal(t, expected, string(body))
+
+				assert.Nil(t, resp.CloseBodyStream())
+				assert.Nil(t, r.decoders)
+			} else {
+				assert.Equal(t, expected, string(resp.Body()))
+			}
+			protocol.ReleaseRequest(req)
+			protocol.ReleaseResponse(resp)
+		}
+
+		cli, _ = client.NewClient(client.WithResponseBodyStream(stream))
+		cli.Use(GzipForClient(DefaultCompression, WithAutoDecompressForClient()))
+		req := protocol.AcquireRequest()
+		resp := protocol.AcquireResponse()
+		req.SetRequestURI("http://127.0.0.1:2351/")
+		req.SetMethod(consts.MethodHead)
+		if err := cli.Do(context.Background(), req, resp); err != nil {
+			t.Fatalf("Head: %v", err)
+		}
+		assert.Equal(t, http.StatusOK, resp.StatusCode())
+		assert.Equal(t, "gzip", resp.Header.Get("Content-Encoding"))
+		body, err := ioutil.ReadAll(resp.BodyStream())
+		assert.Nil(t, err)
+		assert.Equal(t, 0, len(body))
+		protocol.ReleaseRequest(req)
+		protocol.ReleaseResponse(resp)
+
+		// an empty body is left as is, as by DefaultDecompressMiddlewareForClient
+		req = protocol.AcquireRequest()
+		resp = protocol.AcquireResponse()
+		req.SetRequestURI("http://127.0.0.1:2351/empty")
+		if err := cli.Do(context.Background(), req, resp); err != nil {
+			t.Fatalf("Get: %v", err)
+		}
+		assert.Equal(t, http.StatusOK, resp.StatusCode())
+		assert.Equal(t, "gzip", resp.Header.Get("Content-Encoding"))
+		body, err = ioutil.ReadAll(resp.BodyStream())
+		assert.Nil(t, err)
+		assert.Equal(t, 0, len(body))
+		protocol.ReleaseRequest(req)
+		protocol.ReleaseResponse(resp)
+	}
+}
+
+func TestAutoDecompressForClient(t *testing.T) {
+	h := server.Default(server.WithHostPorts("127.0.0.1:2352"))
+
+	h.Use(Gzip(DefaultCompression, WithMinLength(0), WithBrotli(BrotliDefaultCompression)))
+	h.GET("/", func(ctx context.Context, c *app.RequestContext) {
+		c.String(200, testResponse)
+	})
+
+	go h.Spin()
+
+	time.Sleep(time.Second)
+
+	// records the coding of the responses before they are decoded
+	var received string
+	cli, _ := client.NewClient()
+	cli.Use(GzipForClient(DefaultCompression, WithAutoDecompressForClient()),
+		func(next client.Endpoint) client.Endpoint {
+			return func(ctx context.Context, req *protocol.Request, resp *protocol.Response) error {
+				err := next(ctx, req, resp)
+				received = resp.Header.Get("Content-Encoding")
+				return err
+			}
+		})
+
+	for accept, coding := range map[string]string{"": "br", "gzip": "gzip", "identity": ""} {
+		req := protocol.AcquireRequest()
+		resp := protocol.AcquireResponse()
+		req.SetRequestURI("http://127.0.0.1:2352/")
+		if accept != "" {
+			req.Header.Set("Accept-Encoding", accept)
+		}
+		if err := cli.Do(context.Background(), req, resp); err != nil {
+			t.Fatalf("Get: %v", err)
+		}
+		if accept == "" {
+			assert.Equal(t, acceptEncoding(), req.Header.Get("Accept-Encoding"))
+		} else {
+			assert.Equal(t, accept, req.Header.Get("Accept-Encoding"))
+		}
+		assert.Equal(t, coding, received)
+		assert.Equal(t, "", resp.Header.Get("Content-Encoding"))
+		assert.Equal(t, testResponse, string(resp.Body()))
+		protocol.ReleaseRequest(req)
+		protocol.ReleaseResponse(resp)
+	}
+}
+
+func TestAcceptEncodingForClient(t *testing.T) {
+	codings := strings.Split(acceptEncoding(), ", ")
+	assert.Equal(t, "gzip", codings[0])
+	assert.True(t, sort.StringsAreSorted(codings[1:]))
+	for _, coding := range codings {
+		_, ok := LookupDecoder(coding)
+		assert.True(t, ok)
+	}
+}
+
+func TestAutoDecompressForClientKeepsDecompressFn(t *testing.T) {
+	called := false
+	endpoint := newGzipClientMiddleware(DefaultCompression,
+		WithAutoDecompressForClient(),
+		WithDecompressFnForClient(func(next client.Endpoint) client.Endpoint {
+			return func(ctx context.Context, req *protocol.Request, resp *protocol.Response) error {
+				called = true
+				return nil
+			}
+		})).
+		ClientMiddleware(func(ctx context.Context, req *protocol.Request, resp *protocol.Response) error {
+			resp.Header.Set("Content-Encoding", "gzip")
+			return nil
+		})
+
+	req := &protocol.Request{}
+	req.SetRequestURI("http://127.0.0.1/download")
+	assert.Nil(t, endpoint(context.Background(), req, &protocol.Response{}))
+	assert.True(t, called)
+	assert.True(t, strings.HasPrefix(req.Header.Get("Accept-Encoding"), "gzip, "))
+	// a request without a body claims no coding
+	assert.Equal(t, "", req.Header.Get("Content-Encoding"))
+	assert.Equal(t, "", req.Header.Get("Vary"))
+}
@@ -0,0 +1,139 @@
+/*
+ * Copyright 2024 CloudWeGo Authors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package gzip
+
+import (
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Metric names reported to a MetricsSink.
+const (
+	// MetricCompressed counts compressed bodies, labelled by coding.
+	MetricCompressed = "gzip_compressed_total"
+	// MetricSkipped counts bodies sent uncompressed, labelled by reason.
+	MetricSkipped = "gzip_skipped_total"
+	// MetricBytesIn counts the bytes of compressed bodies before compression,
+	// labelled by coding.
+	MetricBytesIn = "gzip_bytes_in_total"
+	// MetricBytesOut counts the bytes of compressed bodies after compression,
+	// labelled by coding.
+	MetricBytesOut = "gzip_bytes_out_total"
+	// MetricCompressDuration observes the seconds spent compressing a body,
+	// labelled by coding.
+	MetricCompressDuration = "gzip_compress_duration_seconds"
+)
+
+// Label names attached to metrics.
+const (
+	LabelCoding = "coding"
+	LabelReason = "reason"
+)
+
+type (
+	// Label is a name-value pair distinguishing series of the same metric.
+	Label struct {
+		Name  string
+		Value string
+	}
+
+	// MetricsSink receives the counters and histograms recorded by the
+	// middlewares, e.g. to export them to Prometheus.
+	// Implementations must be safe for concurrent use.
+	MetricsSink interface {
+		// AddCounter adds delta to the counter identified by name and labels.
+		AddCounter(name string, delta float64, labels ...Label)
+		// ObserveHistogram records value in the histogram identified by name and labels.
+		ObserveHistogram(name string, value float64, labels ...Label)
+	}
+)
+
+// recordCompressed reports a body compressed with coding from in to out bytes in d.
+func recordCompressed(sink MetricsSink, coding string, in, out int, d time.Duration) {
+	if sink == nil {
+		return
+	}
+	label := Label{Name: LabelCoding, Value: coding}
+	sink.AddCounter(MetricCompressed, 1, label)
+	sink.AddCounter(MetricBytesIn, float64(in), label)
+	sink.AddCounter(MetricBytesOut, float64(out), label)
+	sink.ObserveHistogram(MetricCompressDuration, d.Seconds(), label)
+}
+
+// recordSkipped reports a body sent uncompressed for reason.
+func recordSkipped(sink MetricsSink, reason SkipReason) {
+	if sink == nil {
+		return
+	}
+	sink.AddCounter(MetricSkipped, 1, Label{Name: LabelReason, Value: string(reason)})
+}
+
+// MemoryMetrics is a MetricsSink keeping all metrics in memory, mainly for tests.
+type MemoryMetrics struct {
+	mu         sync.Mutex
+	counters   map[string]float64
+	histograms map[string][]float64
+}
+
+// NewMemoryMetrics returns an empty MemoryMetrics.
+func NewMemoryMetrics() *MemoryMetrics {
+	return &MemoryMetrics{
+		counters:   make(map[string]float64),
+		histograms: make(map[string][]float64),
+	}
+}
+
+func (m *MemoryMetrics) AddCounter(name string, delta float64, labels ...Label) {
+	key := seriesKey(name, labels)
+	m.mu.Lock()
+	m.counters[key] += delta
+	m.mu.Unlock()
+}
+
+func (m *MemoryMetrics) ObserveHistogram(name string, value float64, labels ...Label) {
+	key := seriesKey(name, labels)
+	m.mu.Lock()
+	m.histograms[key] = append(m.histograms[key], value)
+	m.mu.Unlock()
+}
+
+// Counter returns the value of the counter identified by name and labels.
+func (m *MemoryMetrics) Counter(name string, labels ...Label) float64 {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.counters[seriesKey(name, labels)]
+}
+
+// Observations returns the values recorded in the histogram identified by
+// name and labels, in the order they were observed.
+func (m *MemoryMetrics) Observations(name string, labels ...Label) []float64 {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return append([]float64(nil), m.histograms[seriesKey(name, labels)]...)
+}
+
+// seriesKey identifies a series regardless of the order of its labels.
+func seriesKey(name string, labels []Label) string {
+	pairs := make([]string, len(labels))
+	for i, l := range labels {
+		pairs[i] = l.Name + "=" + l.Value
+	}
+	sort.Strings(pairs)
+	return name + "{" + strings.Join(pairs, ",") + "}"
+}
@@ -0,0 +1,136 @@
+/*
+ * Copyright 2024 CloudWeGo Authors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package gzip
+
+import (
+	"strings"
+
+	"github.com/cloudwego/hertz/pkg/app"
+)
+
+const negotiatedEncodingKey = "github.com/hertz-contrib/gzip/negotiated-encoding"
+
+// acceptedEncoding is a single element of an Accept-Encoding header.
+type acceptedEncoding struct {
+	coding string
+	q      float64
+}
+
+// NegotiatedEncoding returns the content-coding Gzip or GzipStream negotiated
+// from the Accept-Encoding header of the request, or an empty string if the
+// request is not eligible for compression. The response may still be sent
+// uncompressed, for instance if it is too small; CompressionStats and
+// CompressionSkipReason tell the final outcome once the response is written.
+func NegotiatedEncoding(c *app.RequestContext) string {
+	return c.GetString(negotiatedEncodingKey)
+}
+
+// parseAcceptEncoding parses an Accept-Encoding header value as described in
+// RFC 9110 section 12.5.3. Codings are lower-cased, "x-gzip" is treated as an
+// alias of "gzip" and malformed elements are ignored.
+func parseAcceptEncoding(header string) []acceptedEncoding {
+	var res []acceptedEncoding
+	for _, elem := range strings.Split(header, ",") {
+		params := strings.Split(elem, ";")
+		coding := strings.ToLower(strings.TrimSpace(params[0]))
+		if coding == "" || strings.ContainsAny(coding, " \t") {
+			continue
+		}
+		if coding == "x-gzip" {
+			coding = "gzip"
+		}
+		q, valid := 1.0, true
+		for _, param := range params[1:] {
+			param = strings.TrimSpace(param)
+			if len(param) < 2 || (param[0] != 'q' && param[0] != 'Q') || param[1] != '=' {
+				continue
+			}
+			if q, valid = parseQValue(strings.TrimSpace(param[2:])); !valid {
+				break
+			}
+		}
+		if valid {
+			res = append(res, acceptedEncoding{coding: coding, q: q})
+		}
+	}
+	return res
+}
+
+// parseQValue parses a weight as defined in RFC 9110 section 12.4.2:
+//
+//	qvalue = ( "0" [ "." 0*3DIGIT ] ) / ( "1" [ "." 0*3("0") ] )
+func parseQValue(s string) (float64, bool) {
+	if s == "" || len(s) > 5 || (s[0] != '0' && s[0] != '1') {
+		return 0, false
+	}
+	if len(s) == 1 {
+		return float64(s[0] - '0'), true
+	}
+	if s[1] != '.' {
+		return 0, false
+	}
+	q, scale := 0.0, 0.1
+	for i := 2; i < len(s); i++ {
+		if s[i] < '0' || s[i] > '9' || (s[0] == '1' && s[i] != '0') {
+			return 0, false
+		}
+		q += float64(s[i]-'0') * scale
+		scale /= 10
+	}
+	return float64(s[0]-'0') + q, true
+}
+
+// negotiateEncoding chooses the content-coding for a response among offers,
+// which are listed in server preference order. The coding with the highest
+// weight wins; ties are broken by offer order. It returns an empty string when
+// no offer is acceptable or when the client explicitly prefers identity.
+func negotiateEncoding(header string, offers []string) string {
+	accepted := parseAcceptEncoding(header)
+	if len(accepted) == 0 {
+		return ""
+	}
+
+	weights := make(map[string]float64, len(accepted))
+	for _, a := range accepted {
+		if _, ok := weights[a.coding]; !ok {
+			weights[a.coding] = a.q
+		}
+	}
+	weightOf := func(coding string) (float64, bool) {
+		if q, ok := weights[coding]; ok {
+			return q, true
+		}
+		q, ok := weights["*"]
+		return q, ok
+	}
+
+	best, bestQ := "", 0.0
+	for _, offer := range offers {
+		if q, _ := weightOf(offer); q > bestQ {
+			best, bestQ = offer, q
+		}
+	}
+	if best == "" {
+		return ""
+	}
+	// identity is always implicitly acceptable, but only wins over an
+	// acceptable coding when the client explicitly gives it a higher weight.
+	if q, explicit := weightOf("identity"); explicit && q > bestQ {
+		return ""
+	}
+	return best
+}
@@ -43,22 +43,37 @@ package gzip
 import (
 	"bytes"
 	"context"
-	"net/http"
+	"path"
 	"regexp"
 	"strings"
 
 	"github.com/cloudwego/hertz/pkg/app"
 	"github.com/cloudwego/hertz/pkg/app/client"
-	"github.com/cloudwego/hertz/pkg/common/compress"
 	"github.com/cloudwego/hertz/pkg/protocol"
 )
 
+const (
+	// RangeSkip serves Range requests uncompressed, leaving the handlers
+	// to answer them with partial content.
+	RangeSkip RangePolicy = iota
+	// RangeStrip drops the Range header of requests from clients accepting
+	// compression, so handlers produce the full content, and removes
+	// Accept-Ranges from compressed responses as well as from any response to
+	// such a request, since its ranges were not served.
+	RangeStrip
+)
+
+// DefaultMinLength is the default minimum response body length, in bytes,
+// for the server middlewares to compress it.
+const DefaultMinLength = 1024
+
 var (
 	DefaultExcludedExtensions = NewExcludedExtensions([]string{
 		".png", ".gif", ".jpeg", ".jpg",
 	})
 	DefaultOptions = &Options{
 		ExcludedExtensions: DefaultExcludedExtensions,
+		MinLength:          DefaultMinLength,
 	}
 	DefaultClientExcludedExtensions = NewExcludedExtensions([]string{
 		".png", ".gif", ".jpeg", ".jpg",
@@ -73,20 +88,82 @@ type (
 		ExcludedExtensions  ExcludedExtensions
 		ExcludedPaths       ExcludedPaths
 		ExcludedPathRegexes ExcludedPathRegexes
-		DecompressFn        app.HandlerFunc
+		// IncludedContentTypes, if not empty, restricts compression to responses
+		// whose Content-Type matches one of its patterns.
+		IncludedContentTypes ContentTypes
+		ExcludedContentTypes ContentTypes
+		// ETagPolicy controls how ETags of compressed responses are rewritten.
+		ETagPolicy ETagPolicy
+		// RangePolicy controls how Range requests are handled.
+		RangePolicy  RangePolicy
+		DecompressFn app.HandlerFunc
+		// MinLength is the minimum body length, in bytes, for a response to be
+		// compressed. GzipStream buffers up to MinLength bytes before deciding,
+		// and compresses responses flushed earlier, whose size is not known yet.
+		MinLength int
+		// Encodings lists the registered content-codings offered in addition
+		// to gzip, in order of server preference. gzip is always offered last
+		// unless listed explicitly.
+		Encodings []Encoding
+		// Metrics, if set, receives counters and histograms of the compression activity.
+		Metrics MetricsSink
+		// Tracer, if set, starts spans around compression and decompression.
+		Tracer Tracer
+		// SkipReasonHeader, if set, is the name of a response header telling
+		// why the response was not compressed, for debugging.
+		SkipReasonHeader string
+		// MaxDecompressedSize, if positive, is the maximum size in bytes of a
+		// decompressed request body.
+		MaxDecompressedSize int
+		// MaxDecompressionRatio, if positive, is the maximum ratio between the
+		// sizes of a decompressed request body and of the compressed one.
+		MaxDecompressionRatio int
+		// DecompressErrorHandler, if set, writes the response to requests whose
+		// body failed to decompress, instead of aborting with a bare status code.
+		DecompressErrorHandler DecompressErrorHandler
 	}
 	ClientOptions struct {
 		ExcludedExtensions    ExcludedExtensions
 		ExcludedPaths         ExcludedPaths
 		ExcludedPathRegexes   ExcludedPathRegexes
 		DecompressFnForClient client.Middleware
+		// Encoding is the registered content-coding used for request bodies.
+		// gzip with the level passed to GzipForClient is used if Name is empty.
+		Encoding Encoding
+		// Metrics, if set, receives counters and histograms of the compression activity.
+		Metrics MetricsSink
+		// Tracer, if set, starts spans around compression and decompression.
+		Tracer Tracer
+		// MaxDecompressedSize, if positive, is the maximum size in bytes of a
+		// decompressed response body.
+		MaxDecompressedSize int
+		// MaxDecompressionRatio, if positive, is the maximum ratio between the
+		// sizes of a decompressed response body and of the compressed one.
+		MaxDecompressionRatio int
+		// AutoDecompress advertises the registered decoders in the Accept-Encoding
+		// header of requests which do not set one, and decodes responses with
+		// StreamDecompressMiddlewareForClient unless DecompressFnForClient is set.
+		AutoDecompress bool
+	}
+	// Encoding is a content-coding offered by the server middlewares
+	// together with the compression level used for it.
+	Encoding struct {
+		Name  string
+		Level int
 	}
+	// RangePolicy controls how the server middlewares handle Range requests,
+	// as byte ranges of a compressed response cannot be served from the
+	// uncompressed one. 206 Partial Content responses are never compressed.
+	RangePolicy  int
 	Option       func(*Options)
 	ClientOption func(*ClientOptions)
 
 	ExcludedExtensions  map[string]bool
 	ExcludedPaths       []string
 	ExcludedPathRegexes []*regexp.Regexp
+	// ContentTypes is a list of media type patterns such as "text/html",
+	// "text/*" or "application/*+json".
+	ContentTypes []string
 )
 
 // WithExcludedExtensions customize excluded extensions
@@ -117,6 +194,118 @@ func WithExcludedPaths(args []string) Option {
 	}
 }
 
+// WithMinLength sets the minimum response body length, in bytes, for compression
+// to take place. Smaller bodies are sent uncompressed.
+func WithMinLength(length int) Option {
+	return func(o *Options) {
+		o.MinLength = length
+	}
+}
+
+// WithEncoding offers the content-coding of a registered Encoder with the given
+// level, preferred over gzip and over codings added after it when the client
+// accepts them with equal weight.
+func WithEncoding(name string, level int) Option {
+	return func(o *Options) {
+		o.setEncoding(name, level)
+	}
+}
+
+// WithBrotli offers the "br" content-coding with the given level,
+// preferred over gzip when the client accepts both with equal weight.
+func WithBrotli(level int) Option {
+	return WithEncoding("br", level)
+}
+
+// WithZstd offers the "zstd" content-coding with the given level,
+// preferred over gzip when the client accepts both with equal weight.
+func WithZstd(level int) Option {
+	return WithEncoding("zstd", level)
+}
+
+// WithDeflate offers the "deflate" content-coding with the given level,
+// preferred over gzip when the client accepts both with equal weight.
+func WithDeflate(level int) Option {
+	return WithEncoding("deflate", level)
+}
+
+// WithIncludedContentTypes only compresses responses whose Content-Type matches
+// one of the given patterns, such as "text/*" or "application/*+json"
+func WithIncludedContentTypes(args []string) Option {
+	return func(o *Options) {
+		o.IncludedContentTypes = NewContentTypes(args)
+	}
+}
+
+// WithExcludedContentTypes never compresses responses whose Content-Type matches
+// one of the given patterns, such as "image/*" or "application/zip"
+func WithExcludedContentTypes(args []string) Option {
+	return func(o *Options) {
+		o.ExcludedContentTypes = NewContentTypes(args)
+	}
+}
+
+// WithETagPolicy sets how ETags of compressed responses are rewritten. Incoming
+// If-None-Match and If-Match headers are mapped back before calling the handlers.
+func WithETagPolicy(policy ETagPolicy) Option {
+	return func(o *Options) {
+		o.ETagPolicy = policy
+	}
+}
+
+// WithRangePolicy sets how Range requests are handled
+func WithRangePolicy(policy RangePolicy) Option {
+	return func(o *Options) {
+		o.RangePolicy = policy
+	}
+}
+
+// WithMetrics reports the compression activity to sink
+func WithMetrics(sink MetricsSink) Option {
+	return func(o *Options) {
+		o.Metrics = sink
+	}
+}
+
+// WithTracer starts spans with tracer around compression and decompression
+func WithTracer(tracer Tracer) Option {
+	return func(o *Options) {
+		o.Tracer = tracer
+	}
+}
+
+// WithSkipReasonHeader reports why a response was not compressed in the named
+// response header, such as "X-Gzip-Skip"
+func WithSkipReasonHeader(name string) Option {
+	return func(o *Options) {
+		o.SkipReasonHeader = name
+	}
+}
+
+// WithDecompressErrorHandler sets the handler writing the response to requests
+// whose body failed to decompress
+func WithDecompressErrorHandler(h DecompressErrorHandler) Option {
+	return func(o *Options) {
+		o.DecompressErrorHandler = h
+	}
+}
+
+// WithMaxDecompressedSize limits the size of decompressed request bodies to
+// size bytes
+func WithMaxDecompressedSize(size int) Option {
+	return func(o *Options) {
+		o.MaxDecompressedSize = size
+	}
+}
+
+// WithMaxDecompressionRatio limits decompressed request bodies to ratio times
+// the size of the compressed ones
+func WithMaxDecompressionRatio(ratio int) Option {
+	return func(o *Options) {
+		o.MaxDecompressionRatio = ratio
+	}
+}
+
 func WithDecompressFn(decompressFn app.HandlerFunc) Option {
 	return func(o *Options) {
 		o.DecompressFn = decompressFn
@@ -129,6 +318,62 @@ func WithDecompressFnForClient(decompressFnForClient client.Middleware) ClientOp
 	}
 }
 
+// WithEncodingForClient encodes request bodies with the content-coding of a
+// registered Encoder instead of gzip
+func WithEncodingForClient(name string, level int) ClientOption {
+	return func(o *ClientOptions) {
+		o.Encoding = Encoding{Name: name, Level: level}
+	}
+}
+
+// WithZstdForClient encodes request bodies with zstd instead of gzip
+func WithZstdForClient(level int) ClientOption {
+	return WithEncodingForClient("zstd", level)
+}
+
+// WithDeflateForClient encodes request bodies with deflate instead of gzip
+func WithDeflateForClient(level int) ClientOption {
+	return WithEncodingForClient("deflate", level)
+}
+
+// WithMetricsForClient reports the compression of request bodies to sink
+func WithMetricsForClient(sink MetricsSink) ClientOption {
+	return func(o *ClientOptions) {
+		o.Metrics = sink
+	}
+}
+
+// WithTracerForClient starts spans with tracer around compression and decompression
+func WithTracerForClient(tracer Tracer) ClientOption {
+	return func(o *ClientOptions) {
+		o.Tracer = tracer
+	}
+}
+
+// WithMaxDecompressedSizeForClient limits the size of decompressed response
+// bodies to size bytes
+func WithMaxDecompressedSizeForClient(size int) ClientOption {
+	return func(o *ClientOptions) {
+		o.MaxDecompressedSize = size
+	}
+}
+
+// WithMaxDecompressionRatioForClient limits decompressed response bodies to
+// ratio times the size of the compressed ones
+func WithMaxDecompressionRatioForClient(ratio int) ClientOption {
+	return func(o *ClientOptions) {
+		o.MaxDecompressionRatio = ratio
+	}
+}
+
+// WithAutoDecompressForClient sets Accept-Encoding from the registered decoders,
+// keeping any header set on the request, and decodes the responses
+func WithAutoDecompressForClient() ClientOption {
+	return func(o *ClientOptions) {
+		o.AutoDecompress = true
+	}
+}
+
 // WithExcludedExtensionsForClient customize excluded extensions
 func WithExcludedExtensionsForClient(args []string) ClientOption {
 	return func(o *ClientOptions) {
@@ -149,6 +394,39 @@ func WithExcludedPathsForClient(args []string) ClientOption {
 	}
 }
 
+// clone returns a deep copy of o, so that options applied to one middleware
+// never leak into another through the shared defaults.
+func (o *Options) clone() *Options {
+	res := *o
+	res.ExcludedExtensions = o.ExcludedExtensions.clone()
+	res.ExcludedPaths = append(ExcludedPaths(nil), o.ExcludedPaths...)
+	res.ExcludedPathRegexes = append(ExcludedPathRegexes(nil), o.ExcludedPathRegexes...)
+	res.IncludedContentTypes = append(ContentTypes(nil), o.IncludedContentTypes...)
+	res.ExcludedContentTypes = append(ContentTypes(nil), o.ExcludedContentTypes...)
+	res.Encodings = append([]Encoding(nil), o.Encodings...)
+	return &res
+}
+
+// clone returns a deep copy of o, so that options applied to one middleware
+// never leak into another through the shared defaults.
+func (o *ClientOptions) clone() *ClientOptions {
+	res := *o
+	res.ExcludedExtensions = o.ExcludedExtensions.clone()
+	res.ExcludedPaths = append(ExcludedPaths(nil), o.ExcludedPaths...)
+	res.ExcludedPathRegexes = append(ExcludedPathRegexes(nil), o.ExcludedPathRegexes...)
+	return &res
+}
+
+func (o *Options) setEncoding(name string, level int) {
+	for i := range o.Encodings {
+		if strings.EqualFold(o.Encodings[i].Name, name) {
+			o.Encodings[i].Level = level
+			return
+		}
+	}
+	o.Encodings = append(o.Encodings, Encoding{Name: name, Level: level})
+}
+
 func NewExcludedPaths(paths []string) ExcludedPaths {
 	return ExcludedPaths(paths)
 }
@@ -169,6 +447,29 @@ func NewExcludedPathRegexes(regexes []string) ExcludedPathRegexes {
 	return result
 }
 
+func NewContentTypes(types []string) ContentTypes {
+	res := make(ContentTypes, len(types))
+	for i, t := range types {
+		res[i] = strings.ToLower(strings.TrimSpace(t))
+	}
+	return res
+}
+
+// Contains reports whether the media type of contentType, ignoring any
+// parameters, matches one of the patterns.
+func (t ContentTypes) Contains(contentType string) bool {
+	if i := strings.IndexByte(contentType, ';'); i >= 0 {
+		contentType = contentType[:i]
+	}
+	contentType = strings.ToLower(strings.TrimSpace(contentType))
+	for _, pattern := range t {
+		if matched, _ := path.Match(pattern, contentType); matched {
+			return true
+		}
+	}
+	return false
+}
+
 func (e ExcludedPathRegexes) Contains(requestURI string) bool {
 	for _, reg := range e {
 		if reg.MatchString(requestURI) {
@@ -178,6 +479,17 @@ func (e ExcludedPathRegexes) Contains(requestURI string) bool {
 	return false
 }
 
+func (e ExcludedExtensions) clone() ExcludedExtensions {
+	if e == nil {
+		return nil
+	}
+	res := make(ExcludedExtensions, len(e))
+	for k, v := range e {
+		res[k] = v
+	}
+	return res
+}
+
 func (e ExcludedExtensions) Contains(target string) bool {
 	_, ok := e[target]
 	return ok
@@ -192,33 +504,42 @@ func (e ExcludedPaths) Contains(requestURI string) bool {
 	return false
 }
 
+// DefaultDecompressHandle decompresses the request body, undoing every coding
+// listed in Content-Encoding. Bodies exceeding the limits set with
+// WithMaxDecompressedSize or WithMaxDecompressionRatio are rejected with
+// 413 Request Entity Too Large, unsupported codings with 415 Unsupported Media
+// Type and corrupt bodies with 400 Bad Request, unless a handler is set with
+// WithDecompressErrorHandler.
 func DefaultDecompressHandle(ctx context.Context, c *app.RequestContext) {
 	if len(c.Request.Body()) <= 0 {
 		return
 	}
-	gunzipBytes, err := compress.AppendGunzipBytes(nil, c.Request.Body())
+	decoded, err := decompress(ctx, c.Request.Header.Get("Content-Encoding"), c.Request.Body())
 	if err != nil {
-		_ = c.AbortWithError(http.StatusBadRequest, err)
+		abortDecompress(ctx, c, err)
 		return
 	}
 	c.Request.Header.DelBytes([]byte("Content-Encoding"))
 	c.Request.Header.DelBytes([]byte("Content-Length"))
-	c.Request.SetBody(gunzipBytes)
+	c.Request.SetBody(decoded)
 }
 
+// DefaultDecompressMiddlewareForClient decompresses the response body. Bodies
+// exceeding the limits set with WithMaxDecompressedSizeForClient or
+// WithMaxDecompressionRatioForClient fail with a *DecompressionLimitError.
 func DefaultDecompressMiddlewareForClient(next client.Endpoint) client.Endpoint {
 	return func(ctx context.Context, req *protocol.Request, resp *protocol.Response) (err error) {
 		if len(resp.Body()) <= 0 {
 			return
 		}
-		gunzipBytes, err := compress.AppendGunzipBytes(nil, resp.Body())
+		decoded, err := decompress(ctx, resp.Header.Get("Content-Encoding"), resp.Body())
 		if err != nil {
 			return err
 		}
 		resp.Header.DelBytes([]byte("Content-Encoding"))
 		resp.Header.DelBytes([]byte("Content-Length"))
 		resp.Header.DelBytes([]byte("Vary"))
-		resp.SetBodyStream(bytes.NewBuffer(gunzipBytes), len(gunzipBytes))
+		resp.SetBodyStream(bytes.NewBuffer(decoded), len(decoded))
 		return nil
 	}
 }
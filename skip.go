@@ -0,0 +1,68 @@
+/*
+ * Copyright 2024 CloudWeGo Authors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package gzip
+
+import (
+	"github.com/cloudwego/hertz/pkg/app"
+)
+
+const skipReasonKey = "github.com/hertz-contrib/gzip/skip-reason"
+
+// SkipReason tells why a body is sent uncompressed.
+type SkipReason string
+
+const (
+	// SkipNotAccepted means that Accept-Encoding accepts none of the offered codings.
+	SkipNotAccepted SkipReason = "not_accepted"
+	// SkipRange means that the request carries a Range header under RangeSkip.
+	SkipRange SkipReason = "range"
+	// SkipUpgrade means that the request asks for a connection upgrade.
+	SkipUpgrade SkipReason = "upgrade"
+	// SkipEventStream means that the request accepts text/event-stream.
+	SkipEventStream SkipReason = "event_stream"
+	// SkipExcludedExtension means that the path has an excluded extension.
+	SkipExcludedExtension SkipReason = "excluded_extension"
+	// SkipExcludedPath means that the path matches an excluded path or regex.
+	SkipExcludedPath SkipReason = "excluded_path"
+	// SkipAlreadyEncoded means that the handler already set a Content-Encoding.
+	SkipAlreadyEncoded SkipReason = "already_encoded"
+	// SkipPartialContent means that the response is a 206 Partial Content.
+	SkipPartialContent SkipReason = "partial_content"
+	// SkipContentType means that the Content-Type is not included or is excluded.
+	SkipContentType SkipReason = "content_type"
+	// SkipTooSmall means that the body is shorter than MinLength.
+	SkipTooSmall SkipReason = "too_small"
+	// SkipNoBody means that the response carries no body, e.g. for HEAD
+	// requests and 1xx, 204 and 304 responses.
+	SkipNoBody SkipReason = "no_body"
+)
+
+// CompressionSkipReason returns why Gzip or GzipStream left the current
+// response uncompressed, or an empty string if it is compressed or no decision
+// has been made yet. Reasons depending on the response are known once Gzip
+// returns, and once GzipStream has buffered MinLength bytes or been flushed.
+func CompressionSkipReason(c *app.RequestContext) SkipReason {
+	if v, ok := c.Get(skipReasonKey); ok {
+		if reason, ok := v.(SkipReason); ok {
+			return reason
+		}
+	}
+	if stats := CompressionStats(c); stats != nil {
+		return stats.SkipReason
+	}
+	return ""
+}
@@ -45,68 +45,245 @@ import (
 	"context"
 	"path/filepath"
 	"strings"
+	"time"
 
 	"github.com/cloudwego/hertz/pkg/app"
-	"github.com/cloudwego/hertz/pkg/common/compress"
 	"github.com/cloudwego/hertz/pkg/protocol"
+	"github.com/cloudwego/hertz/pkg/protocol/consts"
 )
 
 type gzipSrvMiddleware struct {
 	*Options
 	level int
+	// encodings lists the offered content-codings in preference order.
+	encodings []string
+	encoders  map[string]Encoder
+	levels    map[string]int
 }
 
 func newGzipSrvMiddleware(level int, opts ...Option) *gzipSrvMiddleware {
 	handler := &gzipSrvMiddleware{
-		Options: DefaultOptions,
-		level:   level,
+		Options:  DefaultOptions.clone(),
+		level:    level,
+		encoders: make(map[string]Encoder),
+		levels:   make(map[string]int),
 	}
 	for _, fn := range opts {
 		fn(handler.Options)
 	}
+	for _, e := range append(handler.Encodings, Encoding{Name: "gzip", Level: level}) {
+		encoder := mustLookupEncoder(e.Name)
+		// offered under the lower-cased name Accept-Encoding is matched against
+		name := strings.ToLower(encoder.Name())
+		if _, ok := handler.encoders[name]; ok {
+			continue
+		}
+		handler.encodings = append(handler.encodings, name)
+		handler.encoders[name] = encoder
+		handler.levels[name] = normalizeLevel(encoder, e.Level)
+	}
 	return handler
 }
 
 func (g *gzipSrvMiddleware) SrvMiddleware(ctx context.Context, c *app.RequestContext) {
-	if fn := g.DecompressFn; fn != nil && strings.EqualFold(c.Request.Header.Get("Content-Encoding"), "gzip") {
-		fn(ctx, c)
-	}
-	if !g.shouldCompress(&c.Request) {
+	g.decompressRequest(ctx, c)
+	encoding, skip := g.shouldCompress(&c.Request)
+	if skip != "" {
+		c.Set(skipReasonKey, skip)
+		g.setSkipReasonHeader(&c.Response, skip)
+		g.skipped(ctx, skip)
 		return
 	}
+	c.Set(negotiatedEncodingKey, encoding)
+	stats := &Stats{}
+	c.Set(statsKey, stats)
+	cachedCompressed := g.restoreConditionalHeaders(&c.Request)
+	rangeStripped := g.stripRange(&c.Request)
 
 	c.Next(ctx)
 
-	if len(c.Response.Body()) > 0 {
-		c.Header("Content-Encoding", "gzip")
-		c.Header("Vary", "Accept-Encoding")
-		
-		gzipBytes := compress.AppendGzipBytesLevel(nil, c.Response.Body(), g.level)
-		c.Response.SetBodyStream(bytes.NewBuffer(gzipBytes), len(gzipBytes))
+	if rangeStripped {
+		c.Response.Header.Del("Accept-Ranges")
+	}
+
+	// 1xx, 204 and 304 responses never carry a body
+	if c.Response.Header.MustSkipContentLength() {
+		// a 304 must carry the ETag of the compressed response the client holds
+		if cachedCompressed && c.Response.StatusCode() == consts.StatusNotModified {
+			g.rewriteETag(&c.Response, encoding)
+		}
+		stats.SkipReason = SkipNoBody
+		g.setSkipReasonHeader(&c.Response, SkipNoBody)
+		g.skipped(ctx, SkipNoBody)
+		return
+	}
+
+	body := c.Response.Body()
+	if len(body) == 0 && c.Request.Header.IsHead() {
+		// advertise the coding a GET would get, judging the size by the
+		// Content-Length the handler declared, which no longer applies
+		if length := c.Response.Header.ContentLength(); length > 0 && length >= g.MinLength && g.shouldCompressResponse(&c.Response) == "" {
+			stats.Encoding = encoding
+			c.Header("Content-Encoding", encoding)
+			c.Header("Vary", "Accept-Encoding")
+			c.Response.Header.Del("Content-Length")
+			g.rewriteETag(&c.Response, encoding)
+			g.stripAcceptRanges(&c.Response)
+		}
+		stats.SkipReason = SkipNoBody
+		g.setSkipReasonHeader(&c.Response, SkipNoBody)
+		g.skipped(ctx, SkipNoBody)
+		return
+	}
+
+	stats.OriginalSize = len(body)
+	stats.CompressedSize = len(body)
+	switch {
+	case len(body) == 0:
+		skip = SkipNoBody
+	case len(body) < g.MinLength:
+		skip = SkipTooSmall
+	default:
+		skip = g.shouldCompressResponse(&c.Response)
+	}
+	if skip != "" {
+		stats.SkipReason = skip
+		g.setSkipReasonHeader(&c.Response, skip)
+		g.skipped(ctx, skip)
+		return
 	}
+
+	c.Header("Content-Encoding", encoding)
+	c.Header("Vary", "Accept-Encoding")
+	g.rewriteETag(&c.Response, encoding)
+	g.stripAcceptRanges(&c.Response)
+
+	_, span := startSpan(ctx, g.Tracer, SpanCompress,
+		Attribute{Key: AttrCoding, Value: encoding}, Attribute{Key: AttrLevel, Value: g.levels[encoding]})
+	start := time.Now()
+	encoded := g.encoders[encoding].Append(nil, body, g.levels[encoding])
+	stats.Duration = time.Since(start)
+	stats.Encoding = encoding
+	stats.CompressedSize = len(encoded)
+	span.SetAttributes(sizeAttributes(len(body), len(encoded))...)
+	span.End()
+	c.Response.SetBodyStream(bytes.NewBuffer(encoded), len(encoded))
+	recordCompressed(g.Metrics, encoding, len(body), len(encoded), stats.Duration)
 }
 
-func (g *gzipSrvMiddleware) shouldCompress(req *protocol.Request) bool {
-	if !(strings.Contains(req.Header.Get("Accept-Encoding"), "gzip") ||
-		strings.TrimSpace(req.Header.Get("Accept-Encoding")) == "*") ||
-		strings.Contains(req.Header.Get("Connection"), "Upgrade") ||
-		strings.Contains(req.Header.Get("Accept"), "text/event-stream") {
-		return false
+// decompressRequest runs DecompressFn if the request body is encoded, leaving
+// it to reject codings it cannot decode.
+func (g *gzipSrvMiddleware) decompressRequest(ctx context.Context, c *app.RequestContext) {
+	coding := c.Request.Header.Get("Content-Encoding")
+	fn := g.DecompressFn
+	if fn == nil || len(parseContentEncoding(coding)) == 0 {
+		return
+	}
+	ctx, span := startSpan(ctx, g.Tracer, SpanDecompress, Attribute{Key: AttrCoding, Value: coding})
+	// streamed bodies are left unread, so that fn may decompress them on the fly
+	streamed := c.Request.IsBodyStream()
+	compressed := 0
+	if !streamed {
+		compressed = len(c.Request.Body())
+	}
+	fn(withDecompressErrorHandler(withDecompressLimits(ctx, g.MaxDecompressedSize, g.MaxDecompressionRatio), g.DecompressErrorHandler), c)
+	if !streamed && !c.Request.IsBodyStream() {
+		span.SetAttributes(sizeAttributes(len(c.Request.Body()), compressed)...)
+	}
+	if c.IsAborted() {
+		if err := c.Errors.Last(); err != nil {
+			span.RecordError(err.Err)
+		}
+	}
+	span.End()
+}
+
+// skipped reports that the response is sent uncompressed for reason.
+func (g *gzipSrvMiddleware) skipped(ctx context.Context, reason SkipReason) {
+	recordSkipped(g.Metrics, reason)
+	traceSkipped(ctx, g.Tracer, reason)
+}
+
+// setSkipReasonHeader tells the client why resp is not compressed if
+// SkipReasonHeader is set.
+func (g *gzipSrvMiddleware) setSkipReasonHeader(resp *protocol.Response, reason SkipReason) {
+	if g.SkipReasonHeader != "" {
+		resp.Header.Set(g.SkipReasonHeader, string(reason))
+	}
+}
+
+// shouldCompress returns the content-coding negotiated from the request's
+// Accept-Encoding, or the reason why the response to req must not be compressed.
+func (g *gzipSrvMiddleware) shouldCompress(req *protocol.Request) (encoding string, skip SkipReason) {
+	encoding = negotiateEncoding(req.Header.Get("Accept-Encoding"), g.encodings)
+	if encoding == "" {
+		return "", SkipNotAccepted
+	}
+	if g.RangePolicy == RangeSkip && len(req.Header.Peek("Range")) > 0 {
+		return "", SkipRange
+	}
+	if strings.Contains(req.Header.Get("Connection"), "Upgrade") {
+		return "", SkipUpgrade
+	}
+	if strings.Contains(req.Header.Get("Accept"), "text/event-stream") {
+		return "", SkipEventStream
 	}
 
 	path := string(req.URI().RequestURI())
 
 	extension := filepath.Ext(path)
 	if g.ExcludedExtensions.Contains(extension) {
-		return false
+		return "", SkipExcludedExtension
 	}
 
 	if g.ExcludedPaths.Contains(path) {
-		return false
+		return "", SkipExcludedPath
 	}
 	if g.ExcludedPathRegexes.Contains(path) {
-		return false
+		return "", SkipExcludedPath
 	}
 
+	return encoding, ""
+}
+
+// shouldCompressResponse returns the reason why resp, as produced by the
+// handlers, must not be compressed, or an empty string if it may be.
+func (g *gzipSrvMiddleware) shouldCompressResponse(resp *protocol.Response) SkipReason {
+	// the handler may have already encoded the body, e.g. by serving a
+	// pre-compressed file or proxying an upstream response
+	if ce := strings.TrimSpace(string(resp.Header.Peek("Content-Encoding"))); ce != "" && !strings.EqualFold(ce, "identity") {
+		return SkipAlreadyEncoded
+	}
+	if resp.StatusCode() == consts.StatusPartialContent {
+		return SkipPartialContent
+	}
+	contentType := string(resp.Header.ContentType())
+	if len(g.IncludedContentTypes) > 0 && !g.IncludedContentTypes.Contains(contentType) {
+		return SkipContentType
+	}
+	if g.ExcludedContentTypes.Contains(contentType) {
+		return SkipContentType
+	}
+	return ""
+}
+
+// stripRange removes the Range header of req under RangeStrip, so that
+// handlers produce the full response to be compressed, and reports whether
+// it did. The response must then not advertise ranges, even if it ends up
+// uncompressed, as they were not served.
+func (g *gzipSrvMiddleware) stripRange(req *protocol.Request) bool {
+	if g.RangePolicy != RangeStrip || len(req.Header.Peek("Range")) == 0 {
+		return false
+	}
+	req.Header.Del("Range")
+	req.Header.Del("If-Range")
 	return true
 }
+
+// stripAcceptRanges removes Accept-Ranges from a compressed response under
+// RangeStrip, as ranges are not served for it.
+func (g *gzipSrvMiddleware) stripAcceptRanges(resp *protocol.Response) {
+	if g.RangePolicy == RangeStrip {
+		resp.Header.Del("Accept-Ranges")
+	}
+}
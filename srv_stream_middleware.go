@@ -41,67 +41,279 @@
 package gzip
 
 import (
+	"bytes"
 	"context"
-	"strings"
 	"sync"
+	"time"
 
 	"github.com/cloudwego/hertz/pkg/app"
-	"github.com/cloudwego/hertz/pkg/common/compress"
 	"github.com/cloudwego/hertz/pkg/network"
 	"github.com/cloudwego/hertz/pkg/protocol"
+	"github.com/cloudwego/hertz/pkg/protocol/consts"
 	"github.com/cloudwego/hertz/pkg/protocol/http1/ext"
 	"github.com/cloudwego/hertz/pkg/protocol/http1/resp"
 )
 
 type gzipChunkedWriter struct {
 	sync.Once
-	level          int
-	originalSize   int
-	compressedSize int
-	wroteHeader    bool
-	finalizeErr    error
-	r              *protocol.Response
-	w              network.Writer
+	// ctx is the context of the request, parent of span.
+	ctx context.Context
+	// span covers the compression of the body, if compressed.
+	span Span
+	srv  *gzipSrvMiddleware
+	// coding is the name of the negotiated content-coding.
+	coding      string
+	encoder     Encoder
+	level       int
+	stats       *Stats
+	wroteHeader bool
+	head        bool
+	// cachedCompressed tells whether If-None-Match referred to a compressed response
+	cachedCompressed bool
+	// rangeStripped tells whether the Range header of the request was dropped
+	rangeStripped bool
+	finalizeErr   error
+	r             *protocol.Response
+	w             network.Writer
+	// pending holds the data written before deciding whether to compress.
+	pending  []byte
+	decided  bool
+	compress bool
+	// ew is the streaming writer of the encoder, if it has one, writing
+	// its output into buf.
+	ew  EncodeWriter
+	buf bytes.Buffer
 }
 
-func (g *gzipChunkedWriter) Write(p []byte) (n int, err error) {
-	gzipBytes := compress.AppendGzipBytesLevel(nil, p, g.level)
+// encode compresses p. Streaming encoders keep a single compressed stream for
+// the whole response and may buffer p until they are flushed.
+func (g *gzipChunkedWriter) encode(p []byte) ([]byte, error) {
+	defer g.timeEncoder(time.Now())
+	if g.ew == nil {
+		return g.encoder.Append(nil, p, g.level), nil
+	}
+	if _, err := g.ew.Write(p); err != nil {
+		return nil, err
+	}
+	return g.takeBuffered(), nil
+}
 
-	if !g.wroteHeader {
+func (g *gzipChunkedWriter) timeEncoder(start time.Time) {
+	g.stats.Duration += time.Since(start)
+}
+
+// takeBuffered returns the output buffered so far. The buffer is not reused
+// because the network writer may keep a reference to it until flushed.
+func (g *gzipChunkedWriter) takeBuffered() []byte {
+	b := g.buf.Bytes()
+	g.buf = bytes.Buffer{}
+	return b
+}
+
+func (g *gzipChunkedWriter) writeHeader() error {
+	switch {
+	case !g.head:
 		g.r.Header.SetContentLength(-1)
-		g.r.Header.Set("Content-Encoding", "gzip")
+	case g.compress:
+		// the declared length is the one of the uncompressed body
+		g.r.Header.Del("Content-Length")
+	}
+	if g.compress {
+		g.r.Header.Set("Content-Encoding", g.coding)
 		g.r.Header.Set("Vary", "Accept-Encoding")
-		if err = resp.WriteHeader(&g.r.Header, g.w); err != nil {
+		g.srv.rewriteETag(g.r, g.coding)
+		g.srv.stripAcceptRanges(g.r)
+	} else if g.cachedCompressed && g.r.StatusCode() == consts.StatusNotModified {
+		g.srv.rewriteETag(g.r, g.coding)
+	}
+	if g.rangeStripped {
+		g.r.Header.Del("Accept-Ranges")
+	}
+	if err := resp.WriteHeader(&g.r.Header, g.w); err != nil {
+		return err
+	}
+	g.wroteHeader = true
+	return nil
+}
+
+// bodyAllowed reports whether the response may carry a body, which is not the
+// case for HEAD requests and 1xx, 204 and 304 responses.
+func (g *gzipChunkedWriter) bodyAllowed() bool {
+	return !g.head && !g.r.Header.MustSkipContentLength()
+}
+
+// decide chooses between compressing the body and passing it through once
+// MinLength bytes have been written, or earlier if the writer is flushed or
+// finalized, and then writes out the pending data. The body is only judged too
+// small once final, as the size of a response flushed early is still unknown.
+func (g *gzipChunkedWriter) decide(final bool) error {
+	g.decided = true
+	size := len(g.pending)
+	if g.head && size == 0 {
+		// a HEAD handler usually writes no body, but declares its length
+		size = g.r.Header.ContentLength()
+	}
+	var skip SkipReason
+	if final && size < g.srv.MinLength {
+		skip = SkipTooSmall
+	} else {
+		skip = g.srv.shouldCompressResponse(g.r)
+	}
+	g.compress = skip == ""
+	if !g.bodyAllowed() {
+		// a HEAD response still advertises the coding a GET would get
+		g.compress = g.compress && g.head && !g.r.Header.MustSkipContentLength()
+		if g.compress {
+			g.stats.Encoding = g.coding
+		}
+		g.setSkipReason(SkipNoBody)
+		g.pending = nil
+		return nil
+	}
+	if !g.compress {
+		g.setSkipReason(skip)
+	} else {
+		g.stats.Encoding = g.coding
+		_, g.span = startSpan(g.ctx, g.srv.Tracer, SpanCompress,
+			Attribute{Key: AttrCoding, Value: g.stats.Encoding}, Attribute{Key: AttrLevel, Value: g.level})
+		g.ew = g.encoder.NewWriter(&g.buf, g.level)
+	}
+	pending := g.pending
+	g.pending = nil
+	if len(pending) == 0 {
+		return nil
+	}
+	_, err := g.write(pending)
+	return err
+}
+
+// Write consumes p and reports len(p) on success, however many bytes the
+// encoder produced for it.
+func (g *gzipChunkedWriter) Write(p []byte) (n int, err error) {
+	g.stats.OriginalSize += len(p)
+	if !g.decided {
+		g.pending = append(g.pending, p...)
+		if len(g.pending) < g.srv.MinLength {
+			return len(p), nil
+		}
+		return len(p), g.decide(false)
+	}
+	return g.write(p)
+}
+
+func (g *gzipChunkedWriter) write(p []byte) (n int, err error) {
+	if !g.bodyAllowed() {
+		if !g.wroteHeader {
+			err = g.writeHeader()
+		}
+		return len(p), err
+	}
+
+	encoded := p
+	if g.compress {
+		if encoded, err = g.encode(p); err != nil {
 			return
 		}
-		g.wroteHeader = true
 	}
 
-	if err = ext.WriteChunk(g.w, gzipBytes, false); err != nil {
+	if err = g.writeChunk(encoded); err != nil {
 		return
 	}
 
-	g.originalSize += len(p)
-	g.compressedSize += len(gzipBytes)
+	g.stats.CompressedSize += len(encoded)
+
+	return len(p), nil
+}
 
-	return len(gzipBytes), nil
+// OriginalSize returns the number of bytes written by the handler so far.
+func (g *gzipChunkedWriter) OriginalSize() int {
+	return g.stats.OriginalSize
 }
 
+// CompressedSize returns the number of body bytes sent to the client so far,
+// which equals the bytes written once flushed if the response is not compressed.
+func (g *gzipChunkedWriter) CompressedSize() int {
+	return g.stats.CompressedSize
+}
+
+// writeChunk writes the header if needed, then b as a chunk unless it is empty.
+func (g *gzipChunkedWriter) writeChunk(b []byte) error {
+	if !g.wroteHeader {
+		if err := g.writeHeader(); err != nil {
+			return err
+		}
+	}
+	if len(b) == 0 {
+		return nil
+	}
+	return ext.WriteChunk(g.w, b, false)
+}
+
+// Flush sends everything written so far to the client. Streaming encoders
+// perform a sync flush, so the client can decode all of it without the
+// stream being terminated.
 func (g *gzipChunkedWriter) Flush() error {
+	if !g.decided {
+		if err := g.decide(false); err != nil {
+			return err
+		}
+	}
+	if g.ew != nil {
+		start := time.Now()
+		err := g.ew.Flush()
+		g.timeEncoder(start)
+		if err != nil {
+			return err
+		}
+		encoded := g.takeBuffered()
+		if err := g.writeChunk(encoded); err != nil {
+			return err
+		}
+		g.stats.CompressedSize += len(encoded)
+	}
 	return g.w.Flush()
 }
 
 func (g *gzipChunkedWriter) Finalize() error {
 	g.Do(func() {
+		defer g.endSpan()
+		if !g.decided {
+			if g.finalizeErr = g.decide(true); g.finalizeErr != nil {
+				return
+			}
+		}
+		if !g.compress && g.stats.OriginalSize == 0 {
+			g.setSkipReason(SkipNoBody)
+		}
 		// in case no actual data from user
 		if !g.wroteHeader {
-			g.r.Header.SetContentLength(-1)
-			g.r.Header.Set("Content-Encoding", "gzip")
-			g.r.Header.Set("Vary", "Accept-Encoding")
-			if g.finalizeErr = resp.WriteHeader(&g.r.Header, g.w); g.finalizeErr != nil {
+			if g.finalizeErr = g.writeHeader(); g.finalizeErr != nil {
 				return
 			}
-			g.wroteHeader = true
+		}
+		if !g.bodyAllowed() {
+			g.srv.skipped(g.ctx, SkipNoBody)
+			g.finalizeErr = g.w.Flush()
+			return
+		}
+		if g.ew != nil {
+			start := time.Now()
+			g.finalizeErr = g.ew.Close()
+			g.timeEncoder(start)
+			if g.finalizeErr != nil {
+				return
+			}
+			g.ew = nil
+			tail := g.takeBuffered()
+			if g.finalizeErr = g.writeChunk(tail); g.finalizeErr != nil {
+				return
+			}
+			g.stats.CompressedSize += len(tail)
+		}
+		if g.compress {
+			recordCompressed(g.srv.Metrics, g.stats.Encoding, g.stats.OriginalSize, g.stats.CompressedSize, g.stats.Duration)
+		} else {
+			g.srv.skipped(g.ctx, g.stats.SkipReason)
 		}
 		g.finalizeErr = ext.WriteChunk(g.w, nil, true)
 		if g.finalizeErr != nil {
@@ -112,24 +324,59 @@ func (g *gzipChunkedWriter) Finalize() error {
 	return g.finalizeErr
 }
 
-func newGzipChunkedWriter(r *protocol.Response, w network.Writer, level int) network.ExtWriter {
+// setSkipReason records why the body is sent uncompressed, in the response
+// header as well unless it has already been written.
+func (g *gzipChunkedWriter) setSkipReason(reason SkipReason) {
+	g.stats.SkipReason = reason
+	if !g.wroteHeader {
+		g.srv.setSkipReasonHeader(g.r, reason)
+	}
+}
+
+// endSpan ends the compression span, if any, once the response is complete.
+func (g *gzipChunkedWriter) endSpan() {
+	if g.span == nil {
+		return
+	}
+	g.span.SetAttributes(sizeAttributes(g.stats.OriginalSize, g.stats.CompressedSize)...)
+	if g.finalizeErr != nil {
+		g.span.RecordError(g.finalizeErr)
+	}
+	g.span.End()
+}
+
+func newGzipChunkedWriter(ctx context.Context, r *protocol.Response, w network.Writer, srv *gzipSrvMiddleware, encoding string, head bool) *gzipChunkedWriter {
 	extWriter := new(gzipChunkedWriter)
+	extWriter.ctx = ctx
 	extWriter.r = r
 	extWriter.w = w
+	extWriter.head = head
 	extWriter.Once = sync.Once{}
-	extWriter.level = level
+	extWriter.srv = srv
+	extWriter.coding = encoding
+	extWriter.encoder = srv.encoders[encoding]
+	extWriter.level = srv.levels[encoding]
+	extWriter.stats = &Stats{}
 	return extWriter
 }
 
 func (g *gzipSrvMiddleware) SrvStreamMiddleware(ctx context.Context, c *app.RequestContext) {
-	if fn := g.DecompressFn; fn != nil && strings.EqualFold(c.Request.Header.Get("Content-Encoding"), "gzip") {
-		fn(ctx, c)
-	}
-	if !g.shouldCompress(&c.Request) {
+	g.decompressRequest(ctx, c)
+	encoding, skip := g.shouldCompress(&c.Request)
+	if skip != "" {
+		c.Set(skipReasonKey, skip)
+		g.setSkipReasonHeader(&c.Response, skip)
+		g.skipped(ctx, skip)
 		return
 	}
+	c.Set(negotiatedEncodingKey, encoding)
+	cachedCompressed := g.restoreConditionalHeaders(&c.Request)
+	rangeStripped := g.stripRange(&c.Request)
 
-	w := newGzipChunkedWriter(&c.Response, c.GetWriter(), g.level)
+	w := newGzipChunkedWriter(ctx, &c.Response, c.GetWriter(), g, encoding, c.Request.Header.IsHead())
+	w.cachedCompressed = cachedCompressed
+	w.rangeStripped = rangeStripped
+	c.Set(statsKey, w.stats)
 	c.Response.HijackWriter(w)
 
 	c.Next(ctx)
@@ -0,0 +1,61 @@
+/*
+ * Copyright 2024 CloudWeGo Authors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package gzip
+
+import (
+	"time"
+
+	"github.com/cloudwego/hertz/pkg/app"
+)
+
+const statsKey = "github.com/hertz-contrib/gzip/stats"
+
+// Stats describes how a single response was compressed.
+type Stats struct {
+	// Encoding is the content-coding applied to the response, or an empty
+	// string if it was sent unencoded.
+	Encoding string
+	// OriginalSize is the number of body bytes produced by the handlers.
+	OriginalSize int
+	// CompressedSize is the number of body bytes sent to the client.
+	CompressedSize int
+	// Duration is the time spent in the encoder.
+	Duration time.Duration
+	// SkipReason tells why the response was sent unencoded, if it was.
+	SkipReason SkipReason
+}
+
+// Ratio returns CompressedSize divided by OriginalSize, or 1 if there is no body.
+func (s *Stats) Ratio() float64 {
+	if s.OriginalSize == 0 {
+		return 1
+	}
+	return float64(s.CompressedSize) / float64(s.OriginalSize)
+}
+
+// CompressionStats returns the statistics of the current response, or nil if
+// Gzip or GzipStream did not negotiate a content-coding for it. They are final
+// once Gzip returns, whereas GzipStream keeps updating them until the response
+// is finalized after all handlers have returned.
+func CompressionStats(c *app.RequestContext) *Stats {
+	if v, ok := c.Get(statsKey); ok {
+		if s, ok := v.(*Stats); ok {
+			return s
+		}
+	}
+	return nil
+}
@@ -0,0 +1,169 @@
+/*
+ * Copyright 2024 CloudWeGo Authors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package gzip
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// Span names used by the middlewares.
+const (
+	// SpanCompress covers the compression of a body, or records why it was
+	// not compressed.
+	SpanCompress = "gzip.compress"
+	// SpanDecompress covers the decompression of a body.
+	SpanDecompress = "gzip.decompress"
+)
+
+// Attribute keys set on spans.
+const (
+	AttrCoding         = "gzip.coding"
+	AttrLevel          = "gzip.level"
+	AttrOriginalSize   = "gzip.original_size"
+	AttrCompressedSize = "gzip.compressed_size"
+	AttrSkipReason     = "gzip.skip_reason"
+)
+
+type (
+	// Attribute is a key-value pair describing a span. Values are strings or ints.
+	Attribute struct {
+		Key   string
+		Value interface{}
+	}
+
+	// Tracer starts the spans of the middlewares, e.g. by delegating to an
+	// OpenTelemetry tracer. Implementations must be safe for concurrent use.
+	Tracer interface {
+		// Start starts a span as a child of any span in ctx, and returns
+		// it together with a context holding it.
+		Start(ctx context.Context, name string, attrs ...Attribute) (context.Context, Span)
+	}
+
+	// Span is a single operation started by a Tracer.
+	Span interface {
+		SetAttributes(attrs ...Attribute)
+		RecordError(err error)
+		End()
+	}
+)
+
+type noopSpan struct{}
+
+func (noopSpan) SetAttributes(...Attribute) {}
+func (noopSpan) RecordError(error)          {}
+func (noopSpan) End()                       {}
+
+// startSpan starts a span with tracer, or returns a span doing nothing if tracer is nil.
+func startSpan(ctx context.Context, tracer Tracer, name string, attrs ...Attribute) (context.Context, Span) {
+	if tracer == nil {
+		return ctx, noopSpan{}
+	}
+	return tracer.Start(ctx, name, attrs...)
+}
+
+// traceSkipped records a span telling why a body was not compressed.
+func traceSkipped(ctx context.Context, tracer Tracer, reason SkipReason) {
+	_, span := startSpan(ctx, tracer, SpanCompress, Attribute{Key: AttrSkipReason, Value: string(reason)})
+	span.End()
+}
+
+func sizeAttributes(original, compressed int) []Attribute {
+	return []Attribute{
+		{Key: AttrOriginalSize, Value: original},
+		{Key: AttrCompressedSize, Value: compressed},
+	}
+}
+
+// SpanRecorder is a Tracer keeping all spans in memory, mainly for tests.
+type SpanRecorder struct {
+	mu    sync.Mutex
+	spans []*RecordedSpan
+}
+
+// RecordedSpan is a span started by a SpanRecorder.
+type RecordedSpan struct {
+	recorder   *SpanRecorder
+	Name       string
+	Attributes map[string]interface{}
+	Errors     []error
+	StartTime  time.Time
+	EndTime    time.Time
+}
+
+// NewSpanRecorder returns an empty SpanRecorder.
+func NewSpanRecorder() *SpanRecorder {
+	return &SpanRecorder{}
+}
+
+func (r *SpanRecorder) Start(ctx context.Context, name string, attrs ...Attribute) (context.Context, Span) {
+	span := &RecordedSpan{
+		recorder:   r,
+		Name:       name,
+		Attributes: make(map[string]interface{}),
+		StartTime:  time.Now(),
+	}
+	span.SetAttributes(attrs...)
+	r.mu.Lock()
+	r.spans = append(r.spans, span)
+	r.mu.Unlock()
+	return ctx, span
+}
+
+// Spans returns copies of the spans started so far, in start order.
+func (r *SpanRecorder) Spans() []RecordedSpan {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	res := make([]RecordedSpan, len(r.spans))
+	for i, span := range r.spans {
+		res[i] = *span
+		res[i].Attributes = make(map[string]interface{}, len(span.Attributes))
+		for k, v := range span.Attributes {
+			res[i].Attributes[k] = v
+		}
+		res[i].Errors = append([]error(nil), span.Errors...)
+	}
+	return res
+}
+
+// Ended reports whether End has been called.
+func (s *RecordedSpan) Ended() bool {
+	return !s.EndTime.IsZero()
+}
+
+func (s *RecordedSpan) SetAttributes(attrs ...Attribute) {
+	s.recorder.mu.Lock()
+	defer s.recorder.mu.Unlock()
+	for _, attr := range attrs {
+		s.Attributes[attr.Key] = attr.Value
+	}
+}
+
+func (s *RecordedSpan) RecordError(err error) {
+	s.recorder.mu.Lock()
+	defer s.recorder.mu.Unlock()
+	s.Errors = append(s.Errors, err)
+}
+
+func (s *RecordedSpan) End() {
+	s.recorder.mu.Lock()
+	defer s.recorder.mu.Unlock()
+	if s.EndTime.IsZero() {
+		s.EndTime = time.Now()
+	}
+}
@@ -0,0 +1,133 @@
+/*
+ * Copyright 2024 CloudWeGo Authors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package gzip
+
+import (
+	"io"
+	"sync"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+const (
+	ZstdBestCompression    = int(zstd.SpeedBestCompression)
+	ZstdBestSpeed          = int(zstd.SpeedFastest)
+	ZstdDefaultCompression = int(zstd.SpeedDefault)
+)
+
+var (
+	zstdEncoders     [ZstdBestCompression + 1]*zstd.Encoder
+	zstdEncodersLock sync.Mutex
+	zstdWriterPools  [ZstdBestCompression + 1]sync.Pool
+
+	sharedZstdDecoder, _ = zstd.NewReader(nil, zstdDecoderOptions(zstd.WithDecoderConcurrency(0))...)
+)
+
+const (
+	// zstdMaxWindow is the largest window accepted in a zstd frame, the limit
+	// RFC 8878 sets for the HTTP content-coding. Larger windows are rejected
+	// before the decoder allocates them.
+	zstdMaxWindow = 8 << 20
+	// zstdMaxMemory bounds the memory the decoders allocate for a frame,
+	// including the output of bodies decoded in one go.
+	zstdMaxMemory = 256 << 20
+)
+
+// zstdDecoderOptions returns opts followed by the options bounding the memory
+// used by zstd decoders.
+func zstdDecoderOptions(opts ...zstd.DOption) []zstd.DOption {
+	return append(opts, zstd.WithDecoderMaxWindow(zstdMaxWindow), zstd.WithDecoderMaxMemory(zstdMaxMemory))
+}
+
+func normalizeZstdLevel(level int) int {
+	if level < ZstdBestSpeed || level > ZstdBestCompression {
+		return ZstdDefaultCompression
+	}
+	return level
+}
+
+// sharedZstdEncoder returns the encoder used for one-shot compression at the
+// given level. EncodeAll is safe for concurrent use.
+func sharedZstdEncoder(level int) *zstd.Encoder {
+	level = normalizeZstdLevel(level)
+	zstdEncodersLock.Lock()
+	defer zstdEncodersLock.Unlock()
+	if zstdEncoders[level] == nil {
+		zstdEncoders[level], _ = zstd.NewWriter(nil, zstd.WithEncoderLevel(zstd.EncoderLevel(level)))
+	}
+	return zstdEncoders[level]
+}
+
+func acquireZstdWriter(w io.Writer, level int) *zstd.Encoder {
+	level = normalizeZstdLevel(level)
+	if v := zstdWriterPools[level].Get(); v != nil {
+		zw := v.(*zstd.Encoder)
+		zw.Reset(w)
+		return zw
+	}
+	zw, _ := zstd.NewWriter(w, zstd.WithEncoderLevel(zstd.EncoderLevel(level)), zstd.WithEncoderConcurrency(1))
+	return zw
+}
+
+func releaseZstdWriter(zw *zstd.Encoder, level int) {
+	zw.Reset(nil)
+	zstdWriterPools[normalizeZstdLevel(level)].Put(zw)
+}
+
+type zstdEncoder struct{}
+
+func (zstdEncoder) Name() string { return "zstd" }
+
+func (zstdEncoder) Levels() (min, max, def int) {
+	return ZstdBestSpeed, ZstdBestCompression, ZstdDefaultCompression
+}
+
+func (zstdEncoder) NewWriter(w io.Writer, level int) EncodeWriter {
+	return &pooledZstdWriter{Encoder: acquireZstdWriter(w, level), level: level}
+}
+
+func (zstdEncoder) Append(dst, src []byte, level int) []byte {
+	return sharedZstdEncoder(level).EncodeAll(src, dst)
+}
+
+type pooledZstdWriter struct {
+	*zstd.Encoder
+	level int
+}
+
+func (w *pooledZstdWriter) Close() error {
+	err := w.Encoder.Close()
+	releaseZstdWriter(w.Encoder, w.level)
+	w.Encoder = nil
+	return err
+}
+
+type zstdDecoder struct{}
+
+func (zstdDecoder) Name() string { return "zstd" }
+
+func (zstdDecoder) NewReader(r io.Reader) (io.ReadCloser, error) {
+	zr, err := zstd.NewReader(r, zstdDecoderOptions(zstd.WithDecoderConcurrency(1))...)
+	if err != nil {
+		return nil, err
+	}
+	return zr.IOReadCloser(), nil
+}
+
+func (zstdDecoder) Append(dst, src []byte) ([]byte, error) {
+	return sharedZstdDecoder.DecodeAll(src, dst)
+}